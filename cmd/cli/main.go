@@ -21,22 +21,29 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"antrea.io/resource-auditing/pkg/gitops"
 	"antrea.io/resource-auditing/pkg/types"
 
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"time"
 )
 
 // filter flags
 var getAuthor, getSince, getUntil, getResource, getNamespace, getName string
+var getAuditID, getGroup, getImpersonatedUser, getSourceIP, getUserAgent, getRequestURI, getResponseCode string
 
 // tag flags
 var tagAuthor, tagEmail string
 
 // rollback flags
-var rollbackTag, rollbackSHA string
+var rollbackTag, rollbackSHA, rollbackResource, rollbackNamespace, rollbackName string
+var rollbackDryRun, rollbackForce, rollbackWait, rollbackFollow bool
+
+// import flags
+var importDir, importRegistry, importNormalization, importRedaction string
 
 // shared flags
 var serverAddr string
@@ -49,12 +56,14 @@ var rootCmd = &cobra.Command{
 }
 
 var getCmd = &cobra.Command{
-	Use:   "get [-a author] [-s since] [-u until] [-r resource] [-n namespace] [-f name]",
+	Use:   "get [-a author] [-s since] [-u until] [-r resource] [-n namespace] [-f name] [provenance flags]",
 	Short: "get changes by author, time range, and filepath",
 	Run:   runGet,
 	Example: ` Getting changes by author and filepath
     $ auditctl get -a kubernetes-admin -r k8s-policies -n default -f allow-client1.yaml
     [{"sha":"a75dc67fd950b5ed052897b981c8d7b2cb05e9a5","author":"kubernetes-admin","message":"Deleted K8s network policy default/allow-client1"}]
+ Getting changes made from a source IP with kubectl
+    $ auditctl get --source-ip 172.18.0.1 --user-agent kubectl
     `,
 }
 
@@ -88,7 +97,7 @@ var tagCmd = &cobra.Command{
 }
 
 var rollbackCmd = &cobra.Command{
-	Use:   "rollback -t tag_name | -s commit_sha",
+	Use:   "rollback -t tag_name | -s commit_sha [-r resource] [-n namespace] [-f name] [--dry-run] [--force] [--wait | --follow]",
 	Short: "rollback to the specified commit by tag name or SHA",
 	Args: func(cmd *cobra.Command, args []string) error {
 		if len(args) != 0 {
@@ -103,12 +112,42 @@ var rollbackCmd = &cobra.Command{
 	Example: `	Rollback by tag name
 	$ auditctl rollback -t new-tag
 	Rollback by commit hash
-	$ auditctl rollback -s 6dd1f926c346f06fc2c57d356ed648a2b518e74c`,
+	$ auditctl rollback -s 6dd1f926c346f06fc2c57d356ed648a2b518e74c
+	Rollback a single policy
+	$ auditctl rollback -t new-tag -r k8s-policies -n default -f allow-client1.yaml
+	Show what a rollback would change without applying it
+	$ auditctl rollback -t new-tag --dry-run
+	Rollback even if resources were changed outside of the audit trail
+	$ auditctl rollback -t new-tag --force
+	Wait for the rollback to finish, printing its progress
+	$ auditctl rollback -t new-tag --follow`,
+}
+
+var revertCmd = &cobra.Command{
+	Use:   "revert commit_sha",
+	Short: "revert the changes introduced by a single commit",
+	Args:  cobra.ExactArgs(1),
+	Run:   runRevert,
+	Example: `	Undo a single change, keeping every later change in place
+	$ auditctl revert 6dd1f926c346f06fc2c57d356ed648a2b518e74c`,
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import log_dir [-d dir] [-c resource_types_file] [--normalization normalization_file] [--redaction redaction_file]",
+	Short: "build a new resource repository from archived audit logs",
+	Args:  cobra.ExactArgs(1),
+	Run:   runImport,
+	Example: `	Create the repository in /data from the audit logs kept before deploying the webhook
+	$ auditctl import /var/log/kubernetes/audit -d /data
+	The webhook then picks up the repository and records the current cluster state
+	$ webhook -d /data`,
 }
 
 func getURL() string {
-	flags := []string{getAuthor, getSince, getUntil, getResource, getNamespace, getName}
-	flagnames := []string{"author", "since", "until", "resource", "namespace", "name"}
+	flags := []string{getAuthor, getSince, getUntil, getResource, getNamespace, getName,
+		getAuditID, getGroup, getImpersonatedUser, getSourceIP, getUserAgent, getRequestURI, getResponseCode}
+	flagnames := []string{"author", "since", "until", "resource", "namespace", "name",
+		"auditID", "group", "impersonatedUser", "sourceIP", "userAgent", "requestURI", "responseCode"}
 	params := url.Values{}
 	for idx, flag := range flags {
 		params.Set(flagnames[idx], flag)
@@ -177,8 +216,13 @@ func runTag(cmd *cobra.Command, args []string) {
 
 func runRollback(cmd *cobra.Command, args []string) {
 	request := types.RollbackRequest{
-		Tag: rollbackTag,
-		Sha: rollbackSHA,
+		Tag:       rollbackTag,
+		Sha:       rollbackSHA,
+		DryRun:    rollbackDryRun,
+		Resource:  rollbackResource,
+		Namespace: rollbackNamespace,
+		Name:      rollbackName,
+		Force:     rollbackForce,
 	}
 	j, err := json.Marshal(request)
 	if err != nil {
@@ -202,24 +246,212 @@ func runRollback(cmd *cobra.Command, args []string) {
 		fmt.Println("Error encountered while processing rollback request")
 		return
 	}
+	if rollbackDryRun {
+		printRollbackPlan(body)
+		return
+	}
+	var job types.RollbackJob
+	if err := json.Unmarshal(body, &job); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if !rollbackWait && !rollbackFollow {
+		fmt.Printf("Rollback job %s submitted\n", job.ID)
+		return
+	}
+	pollRollbackJob(job)
+}
+
+// pollRollbackJob polls the status of a rollback job until it finishes,
+// printing every phase and object state change with --follow.
+func pollRollbackJob(job types.RollbackJob) {
+	url := "http://" + serverAddr + "/rollback/" + job.ID
+	var last types.RollbackJob
+	for {
+		if rollbackFollow {
+			printRollbackProgress(last, job)
+		}
+		if job.Finished() {
+			break
+		}
+		last = job
+		time.Sleep(time.Second)
+		// #nosec G107: need user-provided URL for server
+		resp, err := http.Get(url)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			fmt.Printf("Error encountered while getting status of rollback job %s\n", job.ID)
+			return
+		}
+		job = types.RollbackJob{}
+		if err := json.Unmarshal(body, &job); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	if job.Phase == types.RollbackPhaseFailed {
+		fmt.Printf("Rollback to commit %s failed: %s\n", job.TargetSha, job.Error)
+		if len(job.Drifted) > 0 {
+			fmt.Println("Rerun with --force to overwrite the diverged resources")
+		}
+		return
+	}
+	fmt.Printf("Rollback to commit %s successful\n", job.TargetSha)
+}
+
+func printRollbackProgress(last types.RollbackJob, job types.RollbackJob) {
+	if job.Phase != last.Phase && !job.Finished() {
+		fmt.Printf("phase: %s\n", job.Phase)
+	}
+	previous := map[string]types.RollbackItemState{}
+	for _, item := range last.Items {
+		previous[item.Path] = item.State
+	}
+	for _, item := range job.Items {
+		if item.State == types.RollbackItemPending || previous[item.Path] == item.State {
+			continue
+		}
+		if item.Error != "" {
+			fmt.Printf("  %s %s %s: %s\n", item.Action, item.Path, item.State, item.Error)
+		} else {
+			fmt.Printf("  %s %s %s\n", item.Action, item.Path, item.State)
+		}
+	}
+}
+
+func runRevert(cmd *cobra.Command, args []string) {
+	request := types.RevertRequest{
+		Sha: args[0],
+	}
+	j, err := json.Marshal(request)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	url := "http://" + serverAddr + "/revert"
+	// #nosec G107: need user-provided URL for server
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(j))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if resp.StatusCode == http.StatusConflict {
+		fmt.Println("Unable to revert commit: " + string(body))
+		return
+	}
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusInternalServerError {
+		fmt.Println("Error encountered while processing revert request")
+		return
+	}
 	fmt.Println(string(body))
 }
 
+func runImport(cmd *cobra.Command, args []string) {
+	if importRegistry != "" {
+		registry, err := gitops.LoadResourceRegistry(importRegistry)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		gitops.SetResourceRegistry(registry)
+	}
+	if importNormalization != "" {
+		normalization, err := gitops.LoadNormalizationConfig(importNormalization)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		gitops.SetNormalizationConfig(normalization)
+	}
+	if importRedaction != "" {
+		redaction, err := gitops.LoadRedactionConfig(importRedaction)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		gitops.SetRedactionConfig(redaction)
+	}
+	_, replayed, err := gitops.ImportAuditLogs(gitops.StorageModeDisk, importDir, args[0])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Imported %d audit events from %s\n", replayed, args[0])
+}
+
+func printRollbackPlan(body []byte) {
+	var plan types.RollbackPlan
+	if err := json.Unmarshal(body, &plan); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(plan.Items) == 0 {
+		fmt.Printf("Rollback to commit %s would not change any resources\n", plan.TargetSha)
+		return
+	}
+	fmt.Printf("Rollback from commit %s to commit %s would:\n", plan.HeadSha, plan.TargetSha)
+	for _, item := range plan.Items {
+		name := item.Name
+		if item.Namespace != "" {
+			name = item.Namespace + "/" + item.Name
+		}
+		fmt.Printf("  %s %s %s %s\n", item.Action, item.APIVersion, item.Kind, name)
+	}
+	for _, item := range plan.Items {
+		fmt.Printf("\n%s", item.Diff)
+	}
+}
+
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&serverAddr, "server-addr", "S", "", "address and port of the webhook server")
 	getCmd.Flags().StringVarP(&getAuthor, "author", "a", "", "author of changes")
 	getCmd.Flags().StringVarP(&getSince, "since", "s", "", "start of time range")
 	getCmd.Flags().StringVarP(&getUntil, "until", "u", "", "end of time range")
 	getCmd.Flags().StringVarP(&getResource, "resource", "r", "", "resource name to filter by")
-	getCmd.Flags().StringVarP(&getNamespace, "namespace", "n", "", "namespace to filter by")
+	getCmd.Flags().StringVarP(&getNamespace, "namespace", "n", "", "namespace to filter by, excluding cluster-scoped resources")
 	getCmd.Flags().StringVarP(&getName, "name", "f", "", "name to filter by")
+	getCmd.Flags().StringVar(&getAuditID, "audit-id", "", "audit ID of the request to filter by")
+	getCmd.Flags().StringVar(&getGroup, "group", "", "user group to filter by")
+	getCmd.Flags().StringVar(&getImpersonatedUser, "impersonated-user", "", "impersonated user to filter by")
+	getCmd.Flags().StringVar(&getSourceIP, "source-ip", "", "source IP of the request to filter by")
+	getCmd.Flags().StringVar(&getUserAgent, "user-agent", "", "substring of the user agent to filter by")
+	getCmd.Flags().StringVar(&getRequestURI, "request-uri", "", "prefix of the request URI to filter by")
+	getCmd.Flags().StringVar(&getResponseCode, "response-code", "", "response code of the request to filter by")
 	rootCmd.AddCommand(getCmd)
 	tagCmd.Flags().StringVarP(&tagAuthor, "author", "a", "no-author", "tag author")
 	tagCmd.Flags().StringVarP(&tagEmail, "email", "e", "default@audit.io", "tag email")
 	rootCmd.AddCommand(tagCmd)
 	rollbackCmd.Flags().StringVarP(&rollbackTag, "tag", "t", "", "name of tag to rollback to")
 	rollbackCmd.Flags().StringVarP(&rollbackSHA, "sha", "s", "", "commit hash to rollback to")
+	rollbackCmd.Flags().StringVarP(&rollbackResource, "resource", "r", "", "only rollback resources of this type")
+	rollbackCmd.Flags().StringVarP(&rollbackNamespace, "namespace", "n", "", "only rollback resources in this namespace, excluding cluster-scoped resources")
+	rollbackCmd.Flags().StringVarP(&rollbackName, "name", "f", "", "only rollback resources with this name")
+	rollbackCmd.Flags().BoolVar(&rollbackDryRun, "dry-run", false, "show the changes a rollback would make without applying them")
+	rollbackCmd.Flags().BoolVar(&rollbackForce, "force", false, "rollback even if the cluster has diverged from the repository")
+	rollbackCmd.Flags().BoolVar(&rollbackWait, "wait", false, "wait for the rollback to finish")
+	rollbackCmd.Flags().BoolVar(&rollbackFollow, "follow", false, "wait for the rollback to finish, printing its progress")
 	rootCmd.AddCommand(rollbackCmd)
+	rootCmd.AddCommand(revertCmd)
+	importCmd.Flags().StringVarP(&importDir, "dir", "d", "", "directory where the resource repository is created, defaults to current working directory")
+	importCmd.Flags().StringVarP(&importRegistry, "config", "c", "", "file listing the resource types to audit, defaults to the built-in Kubernetes and Antrea resource types")
+	importCmd.Flags().StringVar(&importNormalization, "normalization", "", "file listing the normalization rules applied to objects, must match the one passed to the webhook")
+	importCmd.Flags().StringVar(&importRedaction, "redaction", "", "file listing the sensitive values replaced with a hash, must match the one passed to the webhook; values already in the repository history are not scrubbed")
+	rootCmd.AddCommand(importCmd)
 }
 
 func main() {
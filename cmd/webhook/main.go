@@ -16,6 +16,7 @@ package main
 
 import (
 	"flag"
+	"time"
 
 	"k8s.io/klog/v2"
 
@@ -26,17 +27,68 @@ import (
 func processArgs() {
 	flag.StringVar(&portFlag, "p", "8080", "specifies port that audit webhook listens on")
 	flag.StringVar(&dirFlag, "d", "", "directory where resource repository is created, defaults to current working directory")
+	flag.StringVar(&registryFlag, "c", "", "file listing the resource types to audit, defaults to the built-in Kubernetes and Antrea resource types")
+	flag.DurationVar(&reconcileFlag, "r", 10*time.Minute, "interval between reconciliations of the repository with cluster state, 0 disables periodic reconciliation")
+	flag.StringVar(&normalizationFlag, "n", "", "file listing the normalization rules applied to objects before they are committed, defaults to dropping server-managed fields")
+	flag.StringVar(&redactionFlag, "s", "", "file listing the sensitive values replaced with a hash before objects are committed, defaults to none; values already in the repository history are not scrubbed")
+	flag.StringVar(&auditLogFlag, "l", "", "JSON-lines audit log file written by the API server log backend to ingest in addition to the webhook")
+	flag.DurationVar(&retentionFlag, "i", 24*time.Hour, "how long IDs of committed audit events are kept to skip duplicates sent by the API server")
+	flag.StringVar(&modeFlag, "m", modeWebhook, "how changes are captured: from audit events (webhook), by watching the cluster (watch), or both")
+	flag.DurationVar(&graceFlag, "g", 10*time.Second, "in mode both, how long a change observed by watching the cluster waits for its audit event before being committed as unattributed")
 	flag.Parse()
 }
 
+const (
+	modeWebhook = "webhook"
+	modeWatch   = "watch"
+	modeBoth    = "both"
+)
+
 var (
-	portFlag string
-	dirFlag  string
+	portFlag          string
+	dirFlag           string
+	registryFlag      string
+	normalizationFlag string
+	redactionFlag     string
+	reconcileFlag     time.Duration
+	retentionFlag     time.Duration
+	auditLogFlag      string
+	modeFlag          string
+	graceFlag         time.Duration
 )
 
 func main() {
 	klog.InitFlags(nil)
 	processArgs()
+	if modeFlag != modeWebhook && modeFlag != modeWatch && modeFlag != modeBoth {
+		klog.Errorf("unsupported capture mode %q", modeFlag)
+		return
+	}
+	if registryFlag != "" {
+		registry, err := gitops.LoadResourceRegistry(registryFlag)
+		if err != nil {
+			klog.ErrorS(err, "unable to load resource registry")
+			return
+		}
+		gitops.SetResourceRegistry(registry)
+	}
+	if normalizationFlag != "" {
+		normalization, err := gitops.LoadNormalizationConfig(normalizationFlag)
+		if err != nil {
+			klog.ErrorS(err, "unable to load normalization config")
+			return
+		}
+		gitops.SetNormalizationConfig(normalization)
+	}
+	if redactionFlag != "" {
+		redaction, err := gitops.LoadRedactionConfig(redactionFlag)
+		if err != nil {
+			klog.ErrorS(err, "unable to load redaction config")
+			return
+		}
+		gitops.SetRedactionConfig(redaction)
+	}
+	gitops.SetAuditIDRetention(retentionFlag)
 	k8s, err := gitops.NewKubernetes()
 	if err != nil {
 		klog.ErrorS(err, "unable to create kube client")
@@ -47,6 +99,29 @@ func main() {
 		klog.ErrorS(err, "unable to set up resource repository")
 		return
 	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go cr.RunEventWorker(stopCh)
+	go cr.RunReconciler(reconcileFlag, stopCh)
+	if auditLogFlag != "" {
+		go cr.TailAuditLog(auditLogFlag, stopCh)
+	}
+	if modeFlag != modeWebhook {
+		dynamicClient, err := gitops.NewDynamicClient()
+		if err != nil {
+			klog.ErrorS(err, "unable to create dynamic kube client")
+			return
+		}
+		delay := time.Duration(0)
+		if modeFlag == modeBoth {
+			delay = graceFlag
+		}
+		go func() {
+			if err := cr.RunWatcher(dynamicClient, delay, stopCh); err != nil {
+				klog.ErrorS(err, "unable to watch audited resources")
+			}
+		}()
+	}
 	if err := webhook.ReceiveEvents(portFlag, cr); err != nil {
 		klog.ErrorS(err, "an error occurred while running the audit webhook service")
 		return
@@ -0,0 +1,247 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/klog/v2"
+
+	"antrea.io/resource-auditing/pkg/types"
+)
+
+// attributionWindow is how long an unattributed change waits for its audit
+// event. Changes are only attributed while the webhook keeps running.
+const attributionWindow = time.Hour
+
+// pendingAttribution is a change committed from a watch event that has not
+// been matched with an audit event yet.
+type pendingAttribution struct {
+	commit          plumbing.Hash
+	resourceVersion string
+	deleted         bool
+	committed       time.Time
+}
+
+// addPendingAttribution records the head commit as an unattributed change to
+// path. Mutex must be held.
+func (cr *CustomRepo) addPendingAttribution(path string, resourceVersion string, deleted bool) error {
+	head, err := cr.Repo.Head()
+	if err != nil {
+		return fmt.Errorf("unable to get repo head: %w", err)
+	}
+	cr.prunePendingAttributions()
+	cr.unattributed[path] = append(cr.unattributed[path], pendingAttribution{
+		commit:          head.Hash(),
+		resourceVersion: resourceVersion,
+		deleted:         deleted,
+		committed:       time.Now(),
+	})
+	return nil
+}
+
+// prunePendingAttributions forgets the changes whose audit event is no longer
+// expected. Mutex must be held.
+func (cr *CustomRepo) prunePendingAttributions() {
+	for path, pending := range cr.unattributed {
+		var kept []pendingAttribution
+		for _, p := range pending {
+			if time.Since(p.committed) < attributionWindow {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			delete(cr.unattributed, path)
+		} else {
+			cr.unattributed[path] = kept
+		}
+	}
+}
+
+// loadPendingAttributions rebuilds the unattributed changes from the commits
+// made within the attribution window, so that audit events replayed after a
+// restart are still matched. Commits already attributed by a note are skipped.
+// Mutex must be held.
+func (cr *CustomRepo) loadPendingAttributions() error {
+	notes, err := cr.readNotes()
+	if err != nil {
+		return err
+	}
+	commits, err := cr.Repo.Log(&git.LogOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to get repo log: %w", err)
+	}
+	var pending []*object.Commit
+	err = commits.ForEach(func(c *object.Commit) error {
+		if time.Since(c.Committer.When) >= attributionWindow {
+			return storer.ErrStop
+		}
+		if _, provenance := ParseProvenance(c.Message); provenance != nil && provenance.Unattributed {
+			if _, ok := notes[c.Hash]; !ok {
+				pending = append(pending, c)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to walk repo log: %w", err)
+	}
+	// The log is walked from the newest commit, while changes are matched from
+	// the last one recorded.
+	loaded := 0
+	for i := len(pending) - 1; i >= 0; i-- {
+		c := pending[i]
+		stats, err := c.Stats()
+		if err != nil {
+			return fmt.Errorf("unable to get files changed by commit %s: %w", c.Hash.String(), err)
+		}
+		if len(stats) != 1 {
+			continue
+		}
+		message, provenance := ParseProvenance(c.Message)
+		path := stats[0].Name
+		cr.unattributed[path] = append(cr.unattributed[path], pendingAttribution{
+			commit:          c.Hash,
+			resourceVersion: provenance.ResourceVersion,
+			deleted:         strings.HasPrefix(message, "Deleted "),
+			committed:       c.Committer.When,
+		})
+		loaded++
+	}
+	klog.V(2).InfoS("loaded unattributed changes", "count", loaded)
+	return nil
+}
+
+// attributeLateEvent matches an audit event with a change already committed
+// from a watch event, and attributes the change to the event with a git note.
+// Updates are matched by resource version and deletions by path. It reports
+// whether the event was matched, in which case there is nothing left to
+// commit. Mutex must be held.
+func (cr *CustomRepo) attributeLateEvent(event auditv1.Event) (bool, error) {
+	path := getRelRepoPath(event) + getFileName(event)
+	var pending []pendingAttribution
+	for _, p := range cr.unattributed[path] {
+		if time.Since(p.committed) < attributionWindow {
+			pending = append(pending, p)
+		}
+	}
+	cr.unattributed[path] = pending
+	if len(pending) == 0 {
+		delete(cr.unattributed, path)
+		return false, nil
+	}
+	deleted := event.Verb == "delete"
+	resourceVersion := ""
+	if !deleted {
+		resourceVersion = responseResourceVersion(event)
+		if resourceVersion == "" {
+			return false, nil
+		}
+	}
+	for i := len(pending) - 1; i >= 0; i-- {
+		p := pending[i]
+		if p.deleted != deleted || p.resourceVersion != resourceVersion {
+			continue
+		}
+		if err := cr.addNote(p.commit, formatAttributionNote(event)); err != nil {
+			return false, fmt.Errorf("unable to attribute commit %s: %w", p.commit.String(), err)
+		}
+		cr.unattributed[path] = append(pending[:i], pending[i+1:]...)
+		klog.V(2).InfoS("attributed watched change to audit event", "commit", p.commit.String(), "auditID", event.AuditID)
+		return true, nil
+	}
+	return false, nil
+}
+
+func responseResourceVersion(event auditv1.Event) string {
+	if event.ResponseObject == nil {
+		return ""
+	}
+	var response struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(event.ResponseObject.Raw, &response); err != nil {
+		return ""
+	}
+	return response.Metadata.ResourceVersion
+}
+
+// formatAttributionNote returns the note attributing a change to the user of
+// an audit event, as an Author line followed by the provenance trailers.
+func formatAttributionNote(event auditv1.Event) string {
+	email := event.User.Username + "+" + event.User.UID + "@audit.antrea.io"
+	return "Author: " + event.User.Username + " <" + email + ">" + formatTrailers(eventProvenance(event)) + "\n"
+}
+
+// parseAttributionNote returns the author and provenance recorded by an
+// attribution note.
+func parseAttributionNote(note string) (string, *types.Provenance, bool) {
+	if !strings.HasPrefix(note, "Author: ") {
+		return "", nil, false
+	}
+	authorLine, provenance := ParseProvenance(note)
+	author := strings.TrimPrefix(authorLine, "Author: ")
+	if i := strings.Index(author, " <"); i >= 0 {
+		author = author[:i]
+	}
+	if provenance == nil {
+		provenance = &types.Provenance{}
+	}
+	return author, provenance, true
+}
+
+// attribution returns the author and provenance of a commit, as amended by an
+// attribution note if any.
+func attribution(commit *object.Commit, notes map[plumbing.Hash]string) (string, *types.Provenance) {
+	_, provenance := ParseProvenance(commit.Message)
+	if note, ok := notes[commit.Hash]; ok {
+		if author, noteProvenance, ok := parseAttributionNote(note); ok {
+			return author, noteProvenance
+		}
+	}
+	return commit.Author.Name, provenance
+}
+
+// Attribution is the author and provenance of a commit.
+type Attribution struct {
+	Author     string
+	Provenance *types.Provenance
+}
+
+// CommitAttributions returns the attribution of each commit, taking into
+// account audit events that arrived after the commit was made.
+func (cr *CustomRepo) CommitAttributions(commits []object.Commit) ([]Attribution, error) {
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	notes, err := cr.readNotes()
+	if err != nil {
+		return nil, err
+	}
+	attributions := make([]Attribution, len(commits))
+	for i := range commits {
+		attributions[i].Author, attributions[i].Provenance = attribution(&commits[i], notes)
+	}
+	return attributions, nil
+}
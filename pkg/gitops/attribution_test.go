@@ -0,0 +1,189 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+func mustMarshalEventList(t *testing.T, events ...auditv1.Event) []byte {
+	j, err := json.Marshal(auditv1.EventList{Items: events})
+	assert.NoError(t, err, "could not marshal event list")
+	return j
+}
+
+func TestAttributeLateEvent(t *testing.T) {
+	k8s := &K8sClient{
+		Client: NewClient(np1.DeepCopy()),
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	resourceType, _ := registry.ByDir("k8s-policies")
+	lateEvent := func(verb string, resource *unstructured.Unstructured) auditv1.Event {
+		event := auditv1.Event{
+			AuditID:        types.UID("late-" + verb),
+			Stage:          auditv1.StageResponseComplete,
+			Verb:           verb,
+			User:           authnv1.UserInfo{Username: "kubernetes-admin", UID: "uid1"},
+			ObjectRef:      &auditv1.ObjectReference{Resource: "networkpolicies", Namespace: "nsA", Name: "npA", APIGroup: "networking.k8s.io"},
+			ResponseStatus: &metav1.Status{Code: 200},
+			StageTimestamp: metav1.NewMicroTime(time.Now()),
+		}
+		if resource != nil {
+			raw, err := json.Marshal(resource)
+			assert.NoError(t, err, "could not marshal resource")
+			event.ResponseObject = &runtime.Unknown{Raw: raw}
+		}
+		return event
+	}
+	headCommit := func() (string, string) {
+		cr.Mutex.Lock()
+		head, err := cr.Repo.Head()
+		cr.Mutex.Unlock()
+		assert.NoError(t, err, "unable to get repo head ref")
+		return head.Hash().String(), headMessage(t, cr)
+	}
+
+	// the watcher commits an update whose audit event was dropped
+	updated := &unstructured.Unstructured{}
+	updated.Object, err = runtime.DefaultUnstructuredConverter.ToUnstructured(np1)
+	assert.NoError(t, err)
+	updated.SetLabels(map[string]string{"app": "late"})
+	updated.SetResourceVersion("42")
+	cr.Mutex.Lock()
+	err = cr.commitWatchedResource(resourceType, "nsA", "npA", updated.DeepCopy(), true)
+	cr.Mutex.Unlock()
+	assert.NoError(t, err, "could not commit watched change")
+	watchedHash, message := headCommit()
+	assert.Equal(t, "Updated K8s network policy nsA/npA", message)
+	commits, err := cr.FilterCommits(unknownAuthor, time.Time{}, time.Time{}, "", "", "", ProvenanceFilter{})
+	assert.NoError(t, err, "could not filter commits")
+	if assert.Len(t, commits, 1, "watched change not committed as unknown actor") {
+		_, provenance := ParseProvenance(commits[0].Message)
+		assert.True(t, provenance.Unattributed)
+	}
+
+	// an audit event for another version of the object is committed as usual
+	other := updated.DeepCopy()
+	other.SetLabels(map[string]string{"app": "other"})
+	other.SetResourceVersion("43")
+	assert.NoError(t, cr.HandleEventList(mustMarshalEventList(t, lateEvent("patch", other))))
+	hash, _ := headCommit()
+	assert.NotEqual(t, watchedHash, hash, "unmatched audit event not committed")
+
+	// the late audit event attributes the watched change instead of committing
+	assert.NoError(t, cr.HandleEventList(mustMarshalEventList(t, lateEvent("update", updated))))
+	newHash, _ := headCommit()
+	assert.Equal(t, hash, newHash, "matched audit event committed")
+	commits, err = cr.FilterCommits("kubernetes-admin", time.Time{}, time.Time{}, "", "", "", ProvenanceFilter{})
+	assert.NoError(t, err, "could not filter commits")
+	var found bool
+	attributions, err := cr.CommitAttributions(commits)
+	assert.NoError(t, err, "could not get commit attributions")
+	for i, c := range commits {
+		if c.Hash.String() == watchedHash {
+			found = true
+			assert.Equal(t, "kubernetes-admin", attributions[i].Author)
+			assert.Equal(t, "late-update", attributions[i].Provenance.AuditID)
+		}
+	}
+	assert.True(t, found, "watched change not attributed to the audit event user")
+	commits, err = cr.FilterCommits(unknownAuthor, time.Time{}, time.Time{}, "", "", "", ProvenanceFilter{})
+	assert.NoError(t, err, "could not filter commits")
+	assert.Empty(t, commits, "attributed change still reported as unknown actor")
+
+	// deletions are matched by path
+	cr.Mutex.Lock()
+	err = cr.commitWatchedResource(resourceType, "nsA", "npA", nil, true)
+	cr.Mutex.Unlock()
+	assert.NoError(t, err, "could not commit watched deletion")
+	deletedHash, message := headCommit()
+	assert.Equal(t, "Deleted K8s network policy nsA/npA", message)
+	assert.NoError(t, cr.HandleEventList(mustMarshalEventList(t, lateEvent("delete", nil))))
+	hash, _ = headCommit()
+	assert.Equal(t, deletedHash, hash, "matched audit event committed")
+	cr.Mutex.Lock()
+	notes, err := cr.readNotes()
+	cr.Mutex.Unlock()
+	assert.NoError(t, err, "could not read notes")
+	assert.Len(t, notes, 2)
+	assert.Contains(t, notes[plumbing.NewHash(deletedHash)], "Author: kubernetes-admin <kubernetes-admin+uid1@audit.antrea.io>\n")
+}
+
+func TestLoadPendingAttributions(t *testing.T) {
+	k8s := &K8sClient{
+		Client: NewClient(np1.DeepCopy()),
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	resourceType, _ := registry.ByDir("k8s-policies")
+	updated := &unstructured.Unstructured{}
+	updated.Object, err = runtime.DefaultUnstructuredConverter.ToUnstructured(np1)
+	assert.NoError(t, err)
+	updated.SetLabels(map[string]string{"app": "late"})
+	updated.SetResourceVersion("42")
+	cr.Mutex.Lock()
+	err = cr.commitWatchedResource(resourceType, "nsA", "npA", updated.DeepCopy(), true)
+	assert.NoError(t, err, "could not commit watched change")
+	head, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+
+	// a restart loses the pending changes held in memory
+	cr.unattributed = map[string][]pendingAttribution{}
+	err = cr.loadPendingAttributions()
+	cr.Mutex.Unlock()
+	assert.NoError(t, err, "could not load unattributed changes")
+	if assert.Len(t, cr.unattributed["k8s-policies/nsA/npA.yaml"], 1, "unattributed change not loaded") {
+		p := cr.unattributed["k8s-policies/nsA/npA.yaml"][0]
+		assert.Equal(t, head.Hash(), p.commit)
+		assert.Equal(t, "42", p.resourceVersion)
+		assert.False(t, p.deleted)
+	}
+
+	raw, err := json.Marshal(updated)
+	assert.NoError(t, err, "could not marshal resource")
+	event := auditv1.Event{
+		AuditID:        types.UID("late-replayed"),
+		Stage:          auditv1.StageResponseComplete,
+		Verb:           "update",
+		User:           authnv1.UserInfo{Username: "kubernetes-admin", UID: "uid1"},
+		ObjectRef:      &auditv1.ObjectReference{Resource: "networkpolicies", Namespace: "nsA", Name: "npA", APIGroup: "networking.k8s.io"},
+		ResponseStatus: &metav1.Status{Code: 200},
+		ResponseObject: &runtime.Unknown{Raw: raw},
+		StageTimestamp: metav1.NewMicroTime(time.Now()),
+	}
+	assert.NoError(t, cr.HandleEventList(mustMarshalEventList(t, event)))
+	cr.Mutex.Lock()
+	notes, err := cr.readNotes()
+	assert.NoError(t, err, "could not read notes")
+	assert.Contains(t, notes[head.Hash()], "Author: kubernetes-admin", "replayed audit event not attributed")
+
+	// attributed changes are not loaded again
+	cr.unattributed = map[string][]pendingAttribution{}
+	assert.NoError(t, cr.loadPendingAttributions(), "could not load unattributed changes")
+	assert.Empty(t, cr.unattributed, "attributed change loaded again")
+	cr.Mutex.Unlock()
+}
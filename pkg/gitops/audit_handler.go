@@ -18,55 +18,110 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"time"
 
 	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
 	"k8s.io/klog/v2"
 )
 
+// HandleEventList commits the changes recorded in a JSON audit EventList. While
+// a rollback is in progress the list is appended to the event queue instead,
+// and committed once the rollback is done.
 func (cr *CustomRepo) HandleEventList(jsonstring []byte) error {
-	cr.Mutex.Lock()
-	defer cr.Mutex.Unlock()
-	eventList := auditv1.EventList{}
 	jsonstring = bytes.TrimPrefix(jsonstring, []byte("\xef\xbb\xbf"))
-	err := json.Unmarshal(jsonstring, &eventList)
-	if err != nil {
+	eventList := auditv1.EventList{}
+	if err := json.Unmarshal(jsonstring, &eventList); err != nil {
 		return fmt.Errorf("could not unmarshal event list json: %w", err)
 	}
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	if queued, err := cr.queueDuringRollback(jsonstring); err != nil {
+		return err
+	} else if queued {
+		return nil
+	}
+	return cr.handleEventList(eventList)
+}
+
+// handleEventList commits the events of a list in the order they were
+// completed by the API server, which may differ from the order of the list. An
+// event that cannot be committed does not stop the ones after it, and the first
+// error is returned once the list is done. Handling the list again only commits
+// the events that failed, as the others are skipped by their audit ID.
+func (cr *CustomRepo) handleEventList(eventList auditv1.EventList) error {
+	sort.SliceStable(eventList.Items, func(i, j int) bool {
+		return eventList.Items[i].StageTimestamp.Before(&eventList.Items[j].StageTimestamp)
+	})
+	var firstErr error
+	failed := 0
 	for _, event := range eventList.Items {
-		if event.Stage != "ResponseComplete" ||
-			event.ResponseStatus.Status == "Failure" ||
-			event.User.Username == cr.ServiceAccount {
-			klog.V(2).InfoS("audit event skipped (audit Stage != ResponseComplete, audit ResponseStatus != Success, or audit produced by rollback)")
+		event = withResponseIdentity(event)
+		if reason := cr.eventSkipReason(event); reason != "" {
+			klog.V(2).InfoS("audit event skipped", "reason", reason, "auditID", event.AuditID)
 			continue
 		}
-		if cr.RollbackMode {
-			return fmt.Errorf("rollback in progress")
+		if err := cr.HandleEvent(event); err != nil {
+			klog.ErrorS(err, "unable to handle audit event", "auditID", event.AuditID)
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+			continue
 		}
-		if err = cr.HandleEvent(event); err != nil {
-			return fmt.Errorf("could not handle event: %w", err)
+		if event.AuditID != "" {
+			if err := cr.auditIDs.add(event.AuditID); err != nil {
+				klog.ErrorS(err, "unable to record committed audit event", "auditID", event.AuditID)
+			}
 		}
 	}
+	if firstErr != nil {
+		return fmt.Errorf("could not handle %d of %d events: %w", failed, len(eventList.Items), firstErr)
+	}
 	return nil
 }
 
 func (cr *CustomRepo) HandleEvent(event auditv1.Event) error {
+	event = withResponseIdentity(event)
 	user := event.User.Username
 	email := event.User.Username + "+" + event.User.UID + "@audit.antrea.io"
-	message := resourceMap[event.ObjectRef.Resource+event.ObjectRef.APIGroup] + event.ObjectRef.Namespace + "/" + event.ObjectRef.Name
+	when := eventTime(event)
+	trailers := formatTrailers(eventProvenance(event))
+	resourceType, ok := getEventResourceType(event)
+	if !ok {
+		return fmt.Errorf("unknown resource type %s in group %s", event.ObjectRef.Resource, event.ObjectRef.APIGroup)
+	}
+	if event.ObjectRef.Name == "" && event.Verb != "deletecollection" {
+		return fmt.Errorf("unable to determine the name of the %s in audit event %s", resourceType.Label, event.AuditID)
+	}
+	message := resourceType.Label + " " + namespacedName(event.ObjectRef.Namespace, event.ObjectRef.Name)
+	if verb := event.Verb; verb == "create" || verb == "patch" || verb == "update" || verb == "delete" {
+		if attributed, err := cr.attributeLateEvent(event); err != nil {
+			return err
+		} else if attributed {
+			return nil
+		}
+		if noOp, err := cr.isNoOpEvent(event); err != nil {
+			return err
+		} else if noOp {
+			klog.V(2).InfoS("audit event skipped", "reason", "repository already up to date", "auditID", event.AuditID)
+			return nil
+		}
+	}
 	switch verb := event.Verb; verb {
 	case "create":
 		if err := cr.modifyFile(event); err != nil {
 			return fmt.Errorf("could not create new resource: %w", err)
 		}
-		if err := cr.AddAndCommit(user, email, "Created "+message); err != nil {
+		if err := cr.addAndCommitAt(user, email, "Created "+message+trailers, when); err != nil {
 			return fmt.Errorf("could not add/commit add operation: %w", err)
 		}
 		klog.V(2).InfoS("successfully created resource", "resource", message)
-	case "patch":
+	case "patch", "update":
 		if err := cr.modifyFile(event); err != nil {
 			return fmt.Errorf("could not update resource: %w", err)
 		}
-		if err := cr.AddAndCommit(user, email, "Updated "+message); err != nil {
+		if err := cr.addAndCommitAt(user, email, "Updated "+message+trailers, when); err != nil {
 			return fmt.Errorf("could not add/commit patch operation: %w", err)
 		}
 		klog.V(2).InfoS("successfully updated resource", "resource", message)
@@ -74,12 +129,37 @@ func (cr *CustomRepo) HandleEvent(event auditv1.Event) error {
 		if err := cr.deleteFile(event); err != nil {
 			return fmt.Errorf("could not delete resource: %w", err)
 		}
-		if err := cr.AddAndCommit(user, email, "Deleted "+message); err != nil {
+		if err := cr.addAndCommitAt(user, email, "Deleted "+message+trailers, when); err != nil {
 			return fmt.Errorf("could not add/commit the delete operation: %w", err)
 		}
 		klog.V(2).InfoS("successfully deleted resource", "resource", message)
+	case "deletecollection":
+		paths, err := cr.getDeletedPaths(event)
+		if err != nil {
+			return fmt.Errorf("could not determine resources removed by delete collection: %w", err)
+		}
+		for _, path := range paths {
+			if err := cr.removePath(path); err != nil {
+				return fmt.Errorf("could not delete resource: %w", err)
+			}
+			namespace, name := pathToNamespacedName(path)
+			message := resourceType.Label + " " + namespacedName(namespace, name)
+			if err := cr.addAndCommitAt(user, email, "Deleted "+message+trailers, when); err != nil {
+				return fmt.Errorf("could not add/commit the delete collection operation: %w", err)
+			}
+			klog.V(2).InfoS("successfully deleted resource", "resource", message)
+		}
 	default:
-		return fmt.Errorf("must be create/patch/delete operation")
+		return fmt.Errorf("must be create/update/patch/delete/deletecollection operation")
 	}
 	return nil
 }
+
+// eventTime returns the time the API server completed the request of an event,
+// or the current time for events without a stage timestamp.
+func eventTime(event auditv1.Event) time.Time {
+	if event.StageTimestamp.IsZero() {
+		return time.Now()
+	}
+	return event.StageTimestamp.Time
+}
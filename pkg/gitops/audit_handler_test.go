@@ -15,11 +15,21 @@
 package gitops
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/go-git/go-billy/v5/util"
 	"github.com/stretchr/testify/assert"
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
 )
 
 func TestHandleEventList(t *testing.T) {
@@ -37,11 +47,6 @@ func TestHandleEventList(t *testing.T) {
 	err = cr.HandleEventList(jsonstring)
 	assert.NoError(t, err, "could not handle correct audit event list")
 
-	cr.RollbackMode = true
-	err = cr.HandleEventList(jsonstring)
-	cr.RollbackMode = false
-	assert.EqualError(t, err, "rollback in progress")
-
 	for i := 1; i < 4; i++ {
 		filename := fmt.Sprintf("%s%d%s", "../../test/files/incorrect-audit-log-", i, ".txt")
 		jsonstring, err := ioutil.ReadFile(filename)
@@ -50,3 +55,239 @@ func TestHandleEventList(t *testing.T) {
 		assert.Error(t, err, "should have returned error on bad audit log")
 	}
 }
+
+func TestQueueDuringRollback(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+
+	jsonstring, err := ioutil.ReadFile("../../test/files/rollback-log.txt")
+	assert.NoError(t, err, "could not read mock audit log")
+	cr.Mutex.Lock()
+	cr.beginRollbackMode()
+	cr.Mutex.Unlock()
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not queue audit event list during rollback")
+	err = cr.HandleEventList([]byte("not an event list"))
+	assert.Error(t, err, "should have returned error on bad audit log during rollback")
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, h.Hash(), newH.Hash(), "audit events committed during rollback")
+
+	cr.Mutex.Lock()
+	cr.endRollbackMode()
+	cr.Mutex.Unlock()
+	newH, err = cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(newH.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	message, _ := ParseProvenance(commit.Message)
+	assert.Equal(t, "Deleted Antrea network policy nsA/anpA", message, "queued audit events not replayed")
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npB.yaml")
+	assert.NoError(t, err, "queued create not replayed")
+	records, err := cr.eventQueue.records()
+	assert.NoError(t, err, "unable to read event queue")
+	assert.Empty(t, records, "event queue not drained")
+}
+
+func TestHandleEventListTimestamps(t *testing.T) {
+	k8s := &K8sClient{
+		Client: NewClient(np1.DeepCopy(), anp1.DeepCopy()),
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+
+	// the log lists the later change first
+	jsonstring, err := ioutil.ReadFile("../../test/files/out-of-order-audit-log.txt")
+	assert.NoError(t, err, "could not read out-of-order audit log")
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not process audit events from file")
+	first := time.Date(2021, 7, 14, 21, 48, 2, 0, time.UTC)
+	second := time.Date(2021, 7, 14, 21, 49, 2, 0, time.UTC)
+
+	y, err := util.ReadFile(cr.Fs, "k8s-policies/nsA/npA.yaml")
+	assert.NoError(t, err, "could not read patched resource")
+	assert.Contains(t, string(y), "app: second", "events not applied in stage timestamp order")
+	head, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(head.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	assert.True(t, second.Equal(commit.Author.When), "author time is not the stage timestamp")
+	assert.True(t, commit.Committer.When.After(second), "committer time is not the commit time")
+
+	commits, err := cr.FilterCommits("", first.Add(-time.Second), first.Add(time.Second), "", "", "", ProvenanceFilter{})
+	assert.NoError(t, err, "could not filter commits by time range")
+	if assert.Len(t, commits, 1, "time range should match the author time") {
+		assert.True(t, first.Equal(commits[0].Author.When))
+	}
+}
+
+func TestHandleEventListDefaultedPolicyTypes(t *testing.T) {
+	k8s := &K8sClient{
+		Client: NewClient(np1.DeepCopy(), anp1.DeepCopy()),
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+
+	// only drops policyTypes, which the server defaults from the rules
+	resource := np1.DeepCopy()
+	resource.Spec.PolicyTypes = nil
+	raw, err := json.Marshal(resource)
+	assert.NoError(t, err, "could not marshal patched policy")
+	eventList := auditv1.EventList{Items: []auditv1.Event{{
+		AuditID:        types.UID("patch-policy-types"),
+		Stage:          "ResponseComplete",
+		Verb:           "patch",
+		User:           authnv1.UserInfo{Username: "kubernetes-admin"},
+		ObjectRef:      &auditv1.ObjectReference{Resource: "networkpolicies", Namespace: "nsA", Name: "npA", APIGroup: "networking.k8s.io"},
+		ResponseStatus: &metav1.Status{Code: 200},
+		ResponseObject: &runtime.Unknown{Raw: raw},
+		StageTimestamp: metav1.NewMicroTime(time.Now()),
+	}}}
+	cr.Mutex.Lock()
+	err = cr.handleEventList(eventList)
+	cr.Mutex.Unlock()
+	assert.NoError(t, err, "could not handle event list")
+
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, h.Hash(), newH.Hash(), "policyTypes-only patch should not create a commit")
+}
+
+func TestHandleEventListGenerateName(t *testing.T) {
+	k8s := &K8sClient{
+		Client: NewClient(np1.DeepCopy(), anp1.DeepCopy()),
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	jsonstring, err := ioutil.ReadFile("../../test/files/generate-name-audit-log.txt")
+	assert.NoError(t, err, "could not read generateName audit log")
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle generateName event list")
+
+	_, err = cr.Fs.Stat("k8s-policies/default/allow-client-x7k2q.yaml")
+	assert.NoError(t, err, "resource created with generateName not named after the generated name")
+	_, err = cr.Fs.Stat("k8s-policies/default/.yaml")
+	assert.True(t, os.IsNotExist(err), "resource created with generateName stored without a name")
+	commits, err := cr.FilterCommits("", time.Time{}, time.Time{}, "k8s-policies", "default", "allow-client-x7k2q.yaml", ProvenanceFilter{})
+	assert.NoError(t, err, "could not filter commits of generated name")
+	if assert.Len(t, commits, 2, "create and patch should both be committed under the generated name") {
+		message, _ := ParseProvenance(commits[1].Message)
+		assert.Equal(t, "Created K8s network policy default/allow-client-x7k2q", message)
+		message, _ = ParseProvenance(commits[0].Message)
+		assert.Equal(t, "Updated K8s network policy default/allow-client-x7k2q", message)
+	}
+}
+
+func TestHandleEventClusterScoped(t *testing.T) {
+	k8s := &K8sClient{
+		Client: NewClient(np1.DeepCopy()),
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	raw, err := json.Marshal(Tier1.inputResource)
+	assert.NoError(t, err, "could not marshal tier")
+	err = cr.HandleEvent(auditv1.Event{
+		Stage:          "ResponseComplete",
+		Verb:           "create",
+		User:           authnv1.UserInfo{Username: "kubernetes-admin"},
+		ObjectRef:      &auditv1.ObjectReference{Resource: "tiers", Name: "TierA", APIGroup: "crd.antrea.io"},
+		ResponseStatus: &metav1.Status{Code: 201},
+		ResponseObject: &runtime.Unknown{Raw: raw},
+	})
+	assert.NoError(t, err, "could not handle tier creation")
+	_, err = cr.Fs.Stat("antrea-tiers/_cluster/TierA.yaml")
+	assert.NoError(t, err, "tier not stored in the _cluster directory")
+	assert.Equal(t, "Created Antrea tier TierA", headMessage(t, cr))
+}
+
+func TestWithResponseIdentity(t *testing.T) {
+	raw, err := json.Marshal(np1)
+	assert.NoError(t, err, "could not marshal policy")
+	event := auditv1.Event{
+		Verb:           "create",
+		ObjectRef:      &auditv1.ObjectReference{Resource: "networkpolicies", APIGroup: "networking.k8s.io"},
+		ResponseObject: &runtime.Unknown{Raw: raw},
+	}
+	completed := withResponseIdentity(event)
+	assert.Equal(t, "nsA", completed.ObjectRef.Namespace)
+	assert.Equal(t, "npA", completed.ObjectRef.Name)
+	assert.Empty(t, event.ObjectRef.Name, "object reference of the original event modified")
+
+	status, err := json.Marshal(metav1.Status{TypeMeta: metav1.TypeMeta{Kind: "Status"}, Status: metav1.StatusSuccess})
+	assert.NoError(t, err, "could not marshal status")
+	event.ResponseObject = &runtime.Unknown{Raw: status}
+	assert.Empty(t, withResponseIdentity(event).ObjectRef.Name, "identity taken from a Status response")
+}
+
+func TestHandleEventVerbs(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), np2.DeepCopy(), anp1.DeepCopy())
+	k8s := &K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+
+	// update (kubectl replace) is recorded like a patch
+	updated := np1.DeepCopy()
+	updated.SetLabels(map[string]string{"app": "replaced"})
+	raw, err := json.Marshal(updated)
+	assert.NoError(t, err, "could not marshal updated policy")
+	err = cr.HandleEvent(auditv1.Event{
+		Verb: "update",
+		User: authnv1.UserInfo{Username: "kubernetes-admin"},
+		ObjectRef: &auditv1.ObjectReference{
+			Resource:  "networkpolicies",
+			Namespace: "nsA",
+			Name:      "npA",
+			APIGroup:  "networking.k8s.io",
+		},
+		ResponseObject: &runtime.Unknown{Raw: raw},
+	})
+	assert.NoError(t, err, "could not handle update event")
+	y, err := util.ReadFile(cr.Fs, "k8s-policies/nsA/npA.yaml")
+	assert.NoError(t, err, "could not read updated resource")
+	assert.Contains(t, string(y), "app: replaced", "update not written to repo")
+	head, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(head.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	assert.Equal(t, "Updated K8s network policy nsA/npA", commit.Message)
+
+	// deletecollection removes every file no longer present in the cluster
+	assert.NoError(t, fakeClient.Delete(context.TODO(), np1.DeepCopy()))
+	assert.NoError(t, fakeClient.Delete(context.TODO(), np2.DeepCopy()))
+	err = cr.HandleEvent(auditv1.Event{
+		Verb: "deletecollection",
+		User: authnv1.UserInfo{Username: "system:serviceaccount:kube-system:namespace-controller"},
+		ObjectRef: &auditv1.ObjectReference{
+			Resource:  "networkpolicies",
+			Namespace: "nsA",
+			APIGroup:  "networking.k8s.io",
+		},
+	})
+	assert.NoError(t, err, "could not handle deletecollection event")
+	for _, path := range []string{"k8s-policies/nsA/npA.yaml", "k8s-policies/nsA/npB.yaml"} {
+		_, err = cr.Fs.Stat(path)
+		assert.True(t, os.IsNotExist(err), "file %s should have been removed", path)
+	}
+	_, err = cr.Fs.Stat("antrea-policies/nsA/anpA.yaml")
+	assert.NoError(t, err, "unrelated resource should not be removed")
+	commits, err := cr.FilterCommits("", time.Time{}, time.Time{}, "k8s-policies", "nsA", "", ProvenanceFilter{})
+	assert.NoError(t, err, "could not filter commits")
+	assert.Equal(t, "Deleted K8s network policy nsA/npB", commits[0].Message)
+	assert.Equal(t, "Deleted K8s network policy nsA/npA", commits[1].Message)
+
+	err = cr.HandleEvent(auditv1.Event{
+		Verb:      "get",
+		ObjectRef: &auditv1.ObjectReference{Resource: "networkpolicies", APIGroup: "networking.k8s.io"},
+	})
+	assert.Error(t, err, "should have returned error on unsupported verb")
+}
@@ -0,0 +1,296 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	auditLogOffsetName = "audit-log.offset"
+	// auditLogFingerprintSize is how much of the start of the audit log is
+	// hashed to recognize it after a restart.
+	auditLogFingerprintSize = 1024
+	// maxAuditLogBatch is the maximum number of events queued as one list.
+	maxAuditLogBatch = 500
+)
+
+var auditLogPollInterval = time.Second
+
+// auditLogTailer follows a JSON-lines audit log written by the log backend of
+// the API server, where every line is an audit Event.
+type auditLogTailer struct {
+	cr   *CustomRepo
+	path string
+	file *os.File
+	// offset is the position in file after the last line queued.
+	offset int64
+	// sum is the fingerprint of file up to offset, to notice when the file is
+	// truncated and written again.
+	sum string
+}
+
+// TailAuditLog queues the events appended to the audit log file at path to be
+// committed like those received by the webhook, until stopCh is closed. The
+// position reached in the file is persisted so that a restart resumes where it
+// left off, and a rotated or truncated file is read again from the start.
+func (cr *CustomRepo) TailAuditLog(path string, stopCh <-chan struct{}) {
+	t := &auditLogTailer{cr: cr, path: path}
+	defer t.close()
+	ticker := time.NewTicker(auditLogPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := t.poll(); err != nil {
+			klog.ErrorS(err, "unable to ingest audit log", "path", path)
+		}
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// poll queues the lines written since the previous poll, and switches to the
+// new file once the log has been rotated.
+func (t *auditLogTailer) poll() error {
+	if t.file == nil {
+		if err := t.open(); err != nil || t.file == nil {
+			return err
+		}
+	}
+	if t.truncated() {
+		klog.V(2).InfoS("audit log truncated, reading from the start", "path", t.path)
+		t.offset = 0
+		t.sum = ""
+	}
+	if err := t.readLines(); err != nil {
+		return err
+	}
+	info, err := os.Stat(t.path)
+	if os.IsNotExist(err) {
+		// Rotated, but the new file has not been created yet.
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to stat audit log %s: %w", t.path, err)
+	}
+	current, err := t.file.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat audit log %s: %w", t.path, err)
+	}
+	if !os.SameFile(info, current) {
+		// Pick up the lines written between the last read and the rotation.
+		if err := t.readLines(); err != nil {
+			return err
+		}
+		klog.V(2).InfoS("audit log rotated, reading new file", "path", t.path)
+		t.close()
+		if err := t.cr.stateFs.Remove(auditLogOffsetName); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to reset audit log offset: %w", err)
+		}
+		return t.poll()
+	}
+	return nil
+}
+
+// open opens the audit log, resuming at the persisted offset if the file is
+// still the one it was recorded for. The tailer is left without a file if the
+// log does not exist yet.
+func (t *auditLogTailer) open() error {
+	f, err := os.Open(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to open audit log %s: %w", t.path, err)
+	}
+	t.file = f
+	t.offset = 0
+	offset, fingerprint, err := t.loadOffset()
+	if err != nil {
+		klog.ErrorS(err, "unable to load audit log offset, reading from the start", "path", t.path)
+		return nil
+	}
+	if offset == 0 {
+		return nil
+	}
+	if current, err := t.fingerprint(offset); err == nil && current == fingerprint {
+		t.offset = offset
+		t.sum = fingerprint
+	} else {
+		klog.V(2).InfoS("audit log replaced since last run, reading from the start", "path", t.path)
+	}
+	return nil
+}
+
+func (t *auditLogTailer) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	t.offset = 0
+	t.sum = ""
+}
+
+// truncated reports whether the file no longer starts with what was read up to
+// the offset. Comparing sizes alone misses a file truncated and then written
+// past the offset again before the next poll.
+func (t *auditLogTailer) truncated() bool {
+	if t.offset == 0 {
+		return false
+	}
+	current, err := t.fingerprint(t.offset)
+	return err != nil || current != t.sum
+}
+
+// readLines queues every complete line after the current offset. A line still
+// being written is left for the next read. Events that cannot change an audited
+// resource, and lines that are not audit events, are skipped.
+func (t *auditLogTailer) readLines() error {
+	if _, err := t.file.Seek(t.offset, io.SeekStart); err != nil {
+		return fmt.Errorf("unable to seek audit log %s: %w", t.path, err)
+	}
+	reader := bufio.NewReader(t.file)
+	offset := t.offset
+	var events []auditv1.Event
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("unable to read audit log %s: %w", t.path, err)
+		}
+		offset += int64(len(line))
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		event := auditv1.Event{}
+		if err := json.Unmarshal(line, &event); err != nil {
+			klog.ErrorS(err, "unable to unmarshal audit log line - skipping", "path", t.path, "offset", offset)
+			continue
+		}
+		if !isAuditedEvent(event) {
+			continue
+		}
+		events = append(events, event)
+		if len(events) == maxAuditLogBatch {
+			if err := t.queue(events, offset); err != nil {
+				return err
+			}
+			events = nil
+		}
+	}
+	if offset == t.offset {
+		return nil
+	}
+	return t.queue(events, offset)
+}
+
+// queue durably queues events and then records offset as the position to
+// resume from. Events queued again after a crash in between are skipped by
+// their audit ID.
+func (t *auditLogTailer) queue(events []auditv1.Event, offset int64) error {
+	if len(events) > 0 {
+		j, err := json.Marshal(auditv1.EventList{Items: events})
+		if err != nil {
+			return fmt.Errorf("unable to marshal audit log events: %w", err)
+		}
+		if err := t.cr.EnqueueEventList(j); err != nil {
+			return err
+		}
+	}
+	t.offset = offset
+	return t.saveOffset()
+}
+
+// isAuditedEvent reports whether an event may record a change to a resource in
+// the repository. The log backend records every request allowed by the audit
+// policy, unlike the webhook whose policy is expected to be narrower.
+func isAuditedEvent(event auditv1.Event) bool {
+	if event.Stage != auditv1.StageResponseComplete || event.ObjectRef == nil {
+		return false
+	}
+	switch event.Verb {
+	case "create", "update", "patch", "delete", "deletecollection":
+	default:
+		return false
+	}
+	_, ok := getEventResourceType(event)
+	return ok
+}
+
+// fingerprint hashes the start of the audit log, up to offset.
+func (t *auditLogTailer) fingerprint(offset int64) (string, error) {
+	if offset > auditLogFingerprintSize {
+		offset = auditLogFingerprintSize
+	}
+	data := make([]byte, offset)
+	if _, err := t.file.ReadAt(data, 0); err != nil {
+		return "", fmt.Errorf("unable to read audit log %s: %w", t.path, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// saveOffset persists the offset along with the fingerprint of the file it
+// refers to, as "<offset> <fingerprint>".
+func (t *auditLogTailer) saveOffset() error {
+	fingerprint, err := t.fingerprint(t.offset)
+	if err != nil {
+		return err
+	}
+	f, err := t.cr.stateFs.Create(auditLogOffsetName)
+	if err != nil {
+		return fmt.Errorf("unable to write audit log offset: %w", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%d %s", t.offset, fingerprint); err != nil {
+		return fmt.Errorf("unable to write audit log offset: %w", err)
+	}
+	t.sum = fingerprint
+	return syncFile(f)
+}
+
+func (t *auditLogTailer) loadOffset() (int64, string, error) {
+	b, err := util.ReadFile(t.cr.stateFs, auditLogOffsetName)
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	} else if err != nil {
+		return 0, "", fmt.Errorf("unable to read audit log offset: %w", err)
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		return 0, "", fmt.Errorf("invalid audit log offset %q", string(b))
+	}
+	offset, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid audit log offset: %w", err)
+	}
+	return offset, fields[1], nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// auditLogLines returns the events of an audit EventList fixture as the lines
+// the log backend would write for them.
+func auditLogLines(t *testing.T, filename string) [][]byte {
+	jsonstring, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err, "could not read mock audit log")
+	eventList := auditv1.EventList{}
+	assert.NoError(t, json.Unmarshal(bytes.TrimPrefix(jsonstring, []byte("\xef\xbb\xbf")), &eventList))
+	var lines [][]byte
+	for _, event := range eventList.Items {
+		line, err := json.Marshal(event)
+		assert.NoError(t, err, "could not marshal audit event")
+		lines = append(lines, append(line, '\n'))
+	}
+	return lines
+}
+
+func appendToFile(t *testing.T, path string, data ...[]byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	assert.NoError(t, err, "could not open audit log")
+	defer f.Close()
+	for _, d := range data {
+		_, err := f.Write(d)
+		assert.NoError(t, err, "could not write audit log")
+	}
+}
+
+func TestTailAuditLog(t *testing.T) {
+	k8s := &K8sClient{
+		Client: NewClient(Np1.inputResource, Anp1.inputResource),
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, "")
+	assert.NoError(t, err, "could not set up mock repo")
+	commitQueued := func() string {
+		cr.Mutex.Lock()
+		cr.drainEventQueue()
+		cr.Mutex.Unlock()
+		return headMessage(t, cr)
+	}
+	lines := auditLogLines(t, "../../test/files/correct-audit-log.txt")
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	tailer := &auditLogTailer{cr: cr, path: path}
+	assert.NoError(t, tailer.poll(), "missing audit log should be waited for")
+
+	// an incomplete line is left until the rest of it is written
+	requestReceived := []byte(`{"kind":"Event","apiVersion":"audit.k8s.io/v1","stage":"RequestReceived","verb":"create"}` + "\n")
+	appendToFile(t, path, requestReceived, []byte("not an event\n"), lines[0], lines[1][:10])
+	assert.NoError(t, tailer.poll(), "could not ingest audit log")
+	assert.Equal(t, "Created K8s network policy default/allow-client1", commitQueued())
+	appendToFile(t, path, lines[1][10:])
+	assert.NoError(t, tailer.poll(), "could not ingest audit log")
+	assert.Equal(t, "Updated K8s network policy default/allow-client1", commitQueued())
+
+	// a restart resumes after the last line queued
+	tailer.close()
+	tailer = &auditLogTailer{cr: cr, path: path}
+	assert.NoError(t, tailer.poll(), "could not resume ingesting audit log")
+	records, err := cr.eventQueue.records()
+	assert.NoError(t, err, "unable to read event queue")
+	assert.Empty(t, records, "audit log lines queued again after restart")
+
+	// a rotated log is read from the start
+	assert.NoError(t, os.Rename(path, path+".1"))
+	appendToFile(t, path, lines[2])
+	assert.NoError(t, tailer.poll(), "could not ingest rotated audit log")
+	assert.Equal(t, "Deleted K8s network policy default/allow-client1", commitQueued())
+	offset, _, err := tailer.loadOffset()
+	assert.NoError(t, err, "unable to load audit log offset")
+	assert.Equal(t, int64(len(lines[2])), offset)
+
+	// a log truncated in place is read from the start, even once it has grown
+	// past the previous offset
+	assert.NoError(t, os.Truncate(path, 0))
+	appendToFile(t, path, lines[0], lines[1])
+	assert.NoError(t, tailer.poll(), "could not ingest truncated audit log")
+	records, err = cr.eventQueue.records()
+	assert.NoError(t, err, "unable to read event queue")
+	if assert.Len(t, records, 1, "truncated audit log not queued") {
+		eventList := auditv1.EventList{}
+		assert.NoError(t, json.Unmarshal(records[0].data, &eventList))
+		assert.Len(t, eventList.Items, 2, "truncated audit log not read from the start")
+	}
+	tailer.close()
+}
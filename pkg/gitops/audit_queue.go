@@ -0,0 +1,175 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/klog/v2"
+)
+
+// maxQueueAttempts is how many times a queued event list is handled before it
+// is moved to the dead-letter queue.
+const maxQueueAttempts = 5
+
+// queueRetryDelay is the delay before handling a failed event list again,
+// doubled with each attempt.
+var queueRetryDelay = time.Second
+
+// EnqueueEventList durably appends a JSON audit EventList to the event queue,
+// to be committed by RunEventWorker. The list is on stable storage when this
+// returns without error.
+func (cr *CustomRepo) EnqueueEventList(jsonstring []byte) error {
+	jsonstring = bytes.TrimPrefix(jsonstring, []byte("\xef\xbb\xbf"))
+	eventList := auditv1.EventList{}
+	if err := json.Unmarshal(jsonstring, &eventList); err != nil {
+		return fmt.Errorf("could not unmarshal event list json: %w", err)
+	}
+	if err := cr.eventQueue.append(jsonstring); err != nil {
+		return fmt.Errorf("unable to queue audit events: %w", err)
+	}
+	cr.wakeEventWorker()
+	return nil
+}
+
+// RunEventWorker commits queued event lists in order until stopCh is closed,
+// starting with any left in the queue by a previous run. A list that fails is
+// retried with backoff before the lists queued after it.
+func (cr *CustomRepo) RunEventWorker(stopCh <-chan struct{}) {
+	for {
+		cr.Mutex.Lock()
+		retry := cr.drainEventQueue()
+		cr.Mutex.Unlock()
+		if retry > 0 {
+			select {
+			case <-time.After(retry):
+			case <-stopCh:
+				return
+			}
+			continue
+		}
+		select {
+		case <-cr.queued:
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// wakeEventWorker makes RunEventWorker drain the queue.
+func (cr *CustomRepo) wakeEventWorker() {
+	select {
+	case cr.queued <- struct{}{}:
+	default:
+	}
+}
+
+// queueDuringRollback durably queues the event list if a rollback is in
+// progress, reporting whether it did. Mutex must be held.
+func (cr *CustomRepo) queueDuringRollback(jsonstring []byte) (bool, error) {
+	if !cr.RollbackMode {
+		return false, nil
+	}
+	if err := cr.eventQueue.append(jsonstring); err != nil {
+		return false, fmt.Errorf("unable to queue audit events received during rollback: %w", err)
+	}
+	klog.V(2).InfoS("rollback in progress - audit events queued")
+	return true, nil
+}
+
+// beginRollbackMode queues audit events until endRollbackMode, and stops the
+// watcher and the reconciler from committing. Mutex must be held.
+func (cr *CustomRepo) beginRollbackMode() {
+	cr.RollbackMode = true
+}
+
+// endRollbackMode stops queueing audit events and commits the ones received
+// during the rollback, in order. Mutex must be held.
+func (cr *CustomRepo) endRollbackMode() {
+	cr.RollbackMode = false
+	if cr.drainEventQueue() > 0 {
+		cr.wakeEventWorker()
+	}
+}
+
+// drainEventQueue commits every queued event list, acknowledging each one as
+// it is done so that a restart resumes after it. A list with events that cannot
+// be committed is left at the head of the queue, and the delay before retrying
+// it is returned. After maxQueueAttempts, or if it cannot be parsed, the list
+// is moved to the dead-letter queue so that it does not block the ones after
+// it. Nothing is committed during a rollback. Mutex must be held.
+func (cr *CustomRepo) drainEventQueue() time.Duration {
+	if cr.RollbackMode {
+		return 0
+	}
+	records, err := cr.eventQueue.records()
+	if err != nil {
+		klog.ErrorS(err, "unable to read queued audit events")
+	}
+	for i, record := range records {
+		eventList := auditv1.EventList{}
+		if err := json.Unmarshal(record.data, &eventList); err != nil {
+			klog.ErrorS(err, "unable to unmarshal queued audit events - moving to dead-letter queue")
+			if !cr.deadLetter(record) {
+				return 0
+			}
+			continue
+		}
+		if err := cr.handleEventList(eventList); err != nil {
+			cr.queueAttempts++
+			if cr.queueAttempts < maxQueueAttempts {
+				delay := queueRetryDelay << (cr.queueAttempts - 1)
+				klog.ErrorS(err, "unable to handle queued audit events - retrying", "attempt", cr.queueAttempts, "delay", delay)
+				if i > 0 {
+					klog.V(2).InfoS("committed queued audit events", "eventLists", i)
+				}
+				return delay
+			}
+			klog.ErrorS(err, "unable to handle queued audit events - moving to dead-letter queue", "attempts", cr.queueAttempts)
+			if !cr.deadLetter(record) {
+				return 0
+			}
+			continue
+		}
+		cr.queueAttempts = 0
+		if err := cr.eventQueue.ack(record.next); err != nil {
+			klog.ErrorS(err, "unable to acknowledge queued audit events")
+			return 0
+		}
+	}
+	if len(records) > 0 {
+		klog.V(2).InfoS("committed queued audit events", "eventLists", len(records))
+	}
+	return 0
+}
+
+// deadLetter moves a queued event list to the dead-letter queue, where it is
+// kept for inspection, reporting whether it did.
+func (cr *CustomRepo) deadLetter(record queueRecord) bool {
+	cr.queueAttempts = 0
+	if err := cr.deadLetters.append(record.data); err != nil {
+		klog.ErrorS(err, "unable to move queued audit events to dead-letter queue")
+		return false
+	}
+	if err := cr.eventQueue.ack(record.next); err != nil {
+		klog.ErrorS(err, "unable to acknowledge queued audit events")
+		return false
+	}
+	return true
+}
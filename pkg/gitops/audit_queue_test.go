@@ -0,0 +1,141 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// headMessage returns the message of the head commit without its trailers. It
+// takes cr.Mutex, so it may be polled while workers commit.
+func headMessage(t *testing.T, cr *CustomRepo) string {
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	message, _ := ParseProvenance(commit.Message)
+	return message
+}
+
+func TestEventWorker(t *testing.T) {
+	k8s := &K8sClient{
+		Client: NewClient(np1.DeepCopy(), anp1.DeepCopy()),
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go cr.RunEventWorker(stopCh)
+
+	jsonstring, err := ioutil.ReadFile("../../test/files/rollback-log.txt")
+	assert.NoError(t, err, "could not read mock audit log")
+	assert.NoError(t, cr.EnqueueEventList(jsonstring), "could not queue audit event list")
+	assert.Error(t, cr.EnqueueEventList([]byte("not an event list")), "should have returned error on bad audit log")
+	assert.Eventually(t, func() bool {
+		return headMessage(t, cr) == "Deleted Antrea network policy nsA/anpA"
+	}, 10*time.Second, 10*time.Millisecond, "queued audit events not committed")
+}
+
+func TestEventQueueResume(t *testing.T) {
+	tmpDir := t.TempDir()
+	k8s := &K8sClient{
+		Client: NewClient(np1.DeepCopy(), anp1.DeepCopy()),
+	}
+	cr, err := SetupRepo(k8s, StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "could not set up repo")
+	jsonstring, err := ioutil.ReadFile("../../test/files/rollback-log.txt")
+	assert.NoError(t, err, "could not read mock audit log")
+	assert.NoError(t, cr.EnqueueEventList(jsonstring), "could not queue audit event list")
+
+	// Restart before the worker ran: queued events are committed on setup
+	cr, err = SetupRepo(k8s, StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "could not reopen repo")
+	commits, err := cr.Repo.Log(&git.LogOptions{})
+	assert.NoError(t, err, "unable to get repo log")
+	var messages []string
+	assert.NoError(t, commits.ForEach(func(c *object.Commit) error {
+		message, _ := ParseProvenance(c.Message)
+		messages = append(messages, message)
+		return nil
+	}))
+	assert.Contains(t, messages, "Deleted Antrea network policy nsA/anpA", "queued audit events not committed after restart")
+	records, err := cr.eventQueue.records()
+	assert.NoError(t, err, "unable to read event queue")
+	assert.Empty(t, records, "event queue not drained after restart")
+}
+
+func TestEventQueueRetry(t *testing.T) {
+	k8s := &K8sClient{
+		Client: NewClient(np1.DeepCopy(), anp1.DeepCopy()),
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	// the patch names no object, so it fails on every attempt
+	failing := auditv1.Event{
+		AuditID:        types.UID("patch-unnamed"),
+		Stage:          auditv1.StageResponseComplete,
+		Verb:           "patch",
+		User:           authnv1.UserInfo{Username: "kubernetes-admin"},
+		ObjectRef:      &auditv1.ObjectReference{Resource: "networkpolicies", Namespace: "nsA", APIGroup: "networking.k8s.io"},
+		ResponseStatus: &metav1.Status{Code: 200},
+	}
+	deleted := auditv1.Event{
+		AuditID:        types.UID("delete-anpA"),
+		Stage:          auditv1.StageResponseComplete,
+		Verb:           "delete",
+		User:           authnv1.UserInfo{Username: "kubernetes-admin"},
+		ObjectRef:      &auditv1.ObjectReference{Resource: "networkpolicies", Namespace: "nsA", Name: "anpA", APIGroup: "crd.antrea.io"},
+		ResponseStatus: &metav1.Status{Code: 200},
+	}
+	assert.NoError(t, cr.EnqueueEventList(mustMarshalEventList(t, failing, deleted)), "could not queue audit event list")
+
+	cr.Mutex.Lock()
+	retry := cr.drainEventQueue()
+	cr.Mutex.Unlock()
+	assert.Equal(t, queueRetryDelay, retry, "failed event list not retried")
+	assert.Equal(t, "Deleted Antrea network policy nsA/anpA", headMessage(t, cr), "events after the failed one not committed")
+	records, err := cr.eventQueue.records()
+	assert.NoError(t, err, "unable to read event queue")
+	assert.Len(t, records, 1, "failed event list acknowledged")
+
+	for attempt := 2; attempt < maxQueueAttempts; attempt++ {
+		cr.Mutex.Lock()
+		retry = cr.drainEventQueue()
+		cr.Mutex.Unlock()
+		assert.Equal(t, queueRetryDelay<<(attempt-1), retry, "retry delay not doubled")
+	}
+	cr.Mutex.Lock()
+	retry = cr.drainEventQueue()
+	cr.Mutex.Unlock()
+	assert.Zero(t, retry, "failed event list retried after the last attempt")
+	records, err = cr.eventQueue.records()
+	assert.NoError(t, err, "unable to read event queue")
+	assert.Empty(t, records, "failed event list left in the queue")
+	records, err = cr.deadLetters.records()
+	assert.NoError(t, err, "unable to read dead-letter queue")
+	assert.Len(t, records, 1, "failed event list not moved to the dead-letter queue")
+}
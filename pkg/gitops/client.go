@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"os"
 
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
 
@@ -38,6 +39,34 @@ type K8sClient struct {
 }
 
 func NewKubernetes() (*K8sClient, error) {
+	config, err := kubeConfig()
+	if err != nil {
+		return nil, err
+	}
+	scheme := runtime.NewScheme()
+	RegisterTypes(scheme)
+	client, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, fmt.Errorf("unable to instantiate new generic client: %w", err)
+	}
+	return &K8sClient{client}, nil
+}
+
+// NewDynamicClient returns a client for watching resources of any audited
+// type, configured like the client returned by NewKubernetes.
+func NewDynamicClient() (dynamic.Interface, error) {
+	config, err := kubeConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to instantiate new dynamic client: %w", err)
+	}
+	return client, nil
+}
+
+func kubeConfig() (*rest.Config, error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		kubeconfig, hasIt := os.LookupEnv("KUBECONFIG")
@@ -49,66 +78,45 @@ func NewKubernetes() (*K8sClient, error) {
 			return nil, fmt.Errorf("unable to build config from flags, check KUBECONFIG file: %w", err)
 		}
 	}
-	scheme := runtime.NewScheme()
-	RegisterTypes(scheme)
-	client, err := client.New(config, client.Options{Scheme: scheme})
-	if err != nil {
-		return nil, fmt.Errorf("unable to instantiate new generic client: %w", err)
-	}
-	return &K8sClient{client}, nil
+	return config, nil
+}
+
+// typedObjects holds the Go types for resource kinds known at compile time.
+// Kinds added through the resource registry without an entry here are handled
+// as unstructured objects.
+var typedObjects = map[schema.GroupVersionKind]runtime.Object{
+	{Group: "networking.k8s.io", Version: "v1", Kind: "NetworkPolicy"}:              &networking.NetworkPolicy{},
+	{Group: "networking.k8s.io", Version: "v1", Kind: "NetworkPolicyList"}:          &networking.NetworkPolicyList{},
+	{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "NetworkPolicy"}:            &v1alpha1.NetworkPolicy{},
+	{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "NetworkPolicyList"}:        &v1alpha1.NetworkPolicyList{},
+	{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "ClusterNetworkPolicy"}:     &v1alpha1.ClusterNetworkPolicy{},
+	{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "ClusterNetworkPolicyList"}: &v1alpha1.ClusterNetworkPolicyList{},
+	{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "Tier"}:                     &v1alpha1.Tier{},
+	{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "TierList"}:                 &v1alpha1.TierList{},
 }
 
 func RegisterTypes(scheme *runtime.Scheme) {
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "networking.k8s.io",
-		Version: "v1",
-		Kind:    "NetworkPolicy"},
-		&networking.NetworkPolicy{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "networking.k8s.io",
-		Version: "v1",
-		Kind:    "NetworkPolicyList"},
-		&networking.NetworkPolicyList{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "networking.k8s.io",
-		Version: "v1",
-		Kind:    "ListOptions"},
-		&metav1.ListOptions{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "NetworkPolicy"},
-		&v1alpha1.NetworkPolicy{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "NetworkPolicyList"},
-		&v1alpha1.NetworkPolicyList{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "ClusterNetworkPolicy"},
-		&v1alpha1.ClusterNetworkPolicy{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "ClusterNetworkPolicyList"},
-		&v1alpha1.ClusterNetworkPolicyList{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "Tier"},
-		&v1alpha1.Tier{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "TierList"},
-		&v1alpha1.TierList{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "ListOptions"},
-		&metav1.ListOptions{})
+	for _, rt := range registry.Types {
+		for _, version := range rt.Versions() {
+			gv := schema.GroupVersion{Group: rt.Group, Version: version}
+			registerType(scheme, gv.WithKind(rt.Kind), &unstructured.Unstructured{})
+			registerType(scheme, gv.WithKind(rt.Kind+"List"), &unstructured.UnstructuredList{})
+			registerType(scheme, gv.WithKind("ListOptions"), &metav1.ListOptions{})
+		}
+	}
+}
+
+// registerType adds gvk to the scheme using its Go type when one is known, and
+// the given fallback object otherwise.
+func registerType(scheme *runtime.Scheme, gvk schema.GroupVersionKind, fallback runtime.Object) {
+	if scheme.Recognizes(gvk) {
+		return
+	}
+	if obj, ok := typedObjects[gvk]; ok {
+		scheme.AddKnownTypeWithName(gvk, obj)
+	} else {
+		scheme.AddKnownTypeWithName(gvk, fallback)
+	}
 }
 
 func (k *K8sClient) GetResource(resource *unstructured.Unstructured, namespace string, name string) (*unstructured.Unstructured, error) {
@@ -122,8 +130,8 @@ func (k *K8sClient) GetResource(resource *unstructured.Unstructured, namespace s
 	return resource, nil
 }
 
-func (k *K8sClient) ListResource(resourceList *unstructured.UnstructuredList) (*unstructured.UnstructuredList, error) {
-	err := k.List(context.TODO(), resourceList)
+func (k *K8sClient) ListResource(resourceList *unstructured.UnstructuredList, opts ...client.ListOption) (*unstructured.UnstructuredList, error) {
+	err := k.List(context.TODO(), resourceList, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to list resource: APIVersion: %s, Kind: %s: %w", resourceList.GetAPIVersion(), resourceList.GetKind(), err)
 	}
@@ -0,0 +1,150 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var auditIDRetention = 24 * time.Hour
+
+// SetAuditIDRetention sets how long the IDs of committed audit events are kept
+// to skip events sent again by the API server. It must be called before the
+// repository is set up.
+func SetAuditIDRetention(retention time.Duration) {
+	auditIDRetention = retention
+}
+
+// auditIDSet records the IDs of committed audit events, persisted as lines of
+// "<auditID> <unix nanoseconds>" appended to a file. Entries older than the
+// retention window are dropped when the file is compacted.
+type auditIDSet struct {
+	fs    billy.Filesystem
+	name  string
+	ids   map[types.UID]time.Time
+	order []types.UID
+	// lines is the number of entries in the file, including expired ones.
+	lines int
+}
+
+func loadAuditIDSet(fs billy.Filesystem, name string) (*auditIDSet, error) {
+	s := &auditIDSet{fs: fs, name: name, ids: map[types.UID]time.Time{}}
+	data, err := util.ReadFile(fs, name)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read processed audit IDs: %w", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		nsec, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		id := types.UID(fields[0])
+		if _, ok := s.ids[id]; !ok {
+			s.order = append(s.order, id)
+		}
+		s.ids[id] = time.Unix(0, nsec)
+	}
+	s.expire(time.Now())
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *auditIDSet) contains(id types.UID) bool {
+	t, ok := s.ids[id]
+	return ok && time.Since(t) < auditIDRetention
+}
+
+// add durably records id as committed.
+func (s *auditIDSet) add(id types.UID) error {
+	now := time.Now()
+	s.expire(now)
+	if _, ok := s.ids[id]; !ok {
+		s.order = append(s.order, id)
+	}
+	s.ids[id] = now
+	f, err := s.fs.OpenFile(s.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open processed audit IDs: %w", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %d\n", id, now.UnixNano()); err != nil {
+		return fmt.Errorf("unable to record processed audit ID: %w", err)
+	}
+	if err := syncFile(f); err != nil {
+		return err
+	}
+	s.lines++
+	if s.lines > 2*len(s.ids)+1000 {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *auditIDSet) expire(now time.Time) {
+	i := 0
+	for ; i < len(s.order); i++ {
+		if now.Sub(s.ids[s.order[i]]) < auditIDRetention {
+			break
+		}
+		delete(s.ids, s.order[i])
+	}
+	s.order = s.order[i:]
+}
+
+// compact rewrites the file with only the IDs still in the retention window.
+func (s *auditIDSet) compact() error {
+	tmpName := s.name + ".tmp"
+	f, err := s.fs.Create(tmpName)
+	if err != nil {
+		return fmt.Errorf("unable to compact processed audit IDs: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	for _, id := range s.order {
+		fmt.Fprintf(w, "%s %d\n", id, s.ids[id].UnixNano())
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to compact processed audit IDs: %w", err)
+	}
+	if err := syncFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := s.fs.Rename(tmpName, s.name); err != nil {
+		return fmt.Errorf("unable to compact processed audit IDs: %w", err)
+	}
+	s.lines = len(s.order)
+	return nil
+}
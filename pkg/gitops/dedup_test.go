@@ -0,0 +1,69 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleEventListDuplicates(t *testing.T) {
+	k8s := &K8sClient{
+		Client: NewClient(np1.DeepCopy(), anp1.DeepCopy()),
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	jsonstring, err := ioutil.ReadFile("../../test/files/rollback-log.txt")
+	assert.NoError(t, err, "could not read mock audit log")
+	assert.NoError(t, cr.HandleEventList(jsonstring), "could not handle audit event list")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+
+	// A retried batch must not create new commits
+	assert.NoError(t, cr.HandleEventList(jsonstring), "could not handle retried audit event list")
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, h.Hash(), newH.Hash(), "duplicate audit events committed")
+}
+
+func TestAuditIDSet(t *testing.T) {
+	fs := memfs.New()
+	s, err := loadAuditIDSet(fs, "ids")
+	assert.NoError(t, err, "unable to load empty audit ID set")
+	assert.False(t, s.contains("a"))
+	assert.NoError(t, s.add("a"))
+	assert.NoError(t, s.add("b"))
+
+	s, err = loadAuditIDSet(fs, "ids")
+	assert.NoError(t, err, "unable to reload audit ID set")
+	assert.True(t, s.contains("a"), "audit ID not persisted")
+	assert.True(t, s.contains("b"), "audit ID not persisted")
+
+	defer SetAuditIDRetention(auditIDRetention)
+	SetAuditIDRetention(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	assert.False(t, s.contains("a"), "audit ID kept past retention")
+	s, err = loadAuditIDSet(fs, "ids")
+	assert.NoError(t, err, "unable to reload audit ID set")
+	assert.Empty(t, s.order, "expired audit IDs not dropped on load")
+	data, err := util.ReadFile(fs, "ids")
+	assert.NoError(t, err, "unable to read audit ID file")
+	assert.Empty(t, data, "expired audit IDs not compacted")
+}
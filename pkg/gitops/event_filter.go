@@ -0,0 +1,90 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/go-git/go-billy/v5/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// eventSkipReason returns why an audit event does not record a change to
+// commit, or an empty string if it may. Mutex must be held.
+func (cr *CustomRepo) eventSkipReason(event auditv1.Event) string {
+	switch {
+	case event.ObjectRef == nil:
+		return "no object reference"
+	case event.Stage != auditv1.StageResponseComplete:
+		return "stage is not ResponseComplete"
+	case requestFailed(event):
+		return "request failed"
+	case isDryRun(event):
+		return "dry run"
+	case event.User.Username == cr.ServiceAccount:
+		return "produced by rollback"
+	case event.AuditID != "" && cr.auditIDs.contains(event.AuditID):
+		return "already committed"
+	}
+	return ""
+}
+
+// requestFailed reports whether the response of a request is not a success.
+// The status of failed requests often only carries the response code.
+func requestFailed(event auditv1.Event) bool {
+	status := event.ResponseStatus
+	if status == nil {
+		return false
+	}
+	if status.Status == metav1.StatusFailure {
+		return true
+	}
+	return status.Code != 0 && (status.Code < 200 || status.Code >= 300)
+}
+
+// isDryRun reports whether a request was made with the dryRun query parameter,
+// in which case nothing was persisted.
+func isDryRun(event auditv1.Event) bool {
+	u, err := url.Parse(event.RequestURI)
+	if err != nil {
+		return false
+	}
+	return len(u.Query()["dryRun"]) > 0
+}
+
+// isNoOpEvent reports whether the repository already holds the result of a
+// create, update, patch or delete, e.g. for patches that changed nothing. Mutex
+// must be held.
+func (cr *CustomRepo) isNoOpEvent(event auditv1.Event) (bool, error) {
+	path := getRelRepoPath(event) + getFileName(event)
+	old, err := util.ReadFile(cr.Fs, path)
+	if os.IsNotExist(err) {
+		return event.Verb == "delete", nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to read file at %s: %w", path, err)
+	}
+	if event.Verb == "delete" {
+		return false, nil
+	}
+	y, err := eventResourceYAML(event)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(old, y), nil
+}
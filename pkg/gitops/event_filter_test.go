@@ -0,0 +1,86 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+func TestEventSkipReason(t *testing.T) {
+	cr := &CustomRepo{ServiceAccount: "system:serviceaccount:kube-system:audit", auditIDs: &auditIDSet{}}
+	event := func(code int32, status string, uri string) auditv1.Event {
+		return auditv1.Event{
+			Stage:          auditv1.StageResponseComplete,
+			RequestURI:     uri,
+			User:           authnv1.UserInfo{Username: "kubernetes-admin"},
+			ObjectRef:      &auditv1.ObjectReference{Resource: "networkpolicies", Namespace: "nsA", Name: "npA"},
+			ResponseStatus: &metav1.Status{Code: code, Status: status},
+		}
+	}
+	uri := "/apis/networking.k8s.io/v1/namespaces/nsA/networkpolicies/npA"
+	assert.Equal(t, "", cr.eventSkipReason(event(200, "", uri)))
+	assert.Equal(t, "", cr.eventSkipReason(event(201, "", uri+"?fieldManager=kubectl-create")))
+	assert.Equal(t, "request failed", cr.eventSkipReason(event(404, "", uri)))
+	assert.Equal(t, "request failed", cr.eventSkipReason(event(500, "", uri)))
+	assert.Equal(t, "request failed", cr.eventSkipReason(event(0, metav1.StatusFailure, uri)))
+	assert.Equal(t, "dry run", cr.eventSkipReason(event(200, "", uri+"?dryRun=All&fieldManager=kubectl-client-side-apply")))
+	received := event(0, "", uri)
+	received.Stage = auditv1.StageRequestReceived
+	received.ResponseStatus = nil
+	assert.Equal(t, "stage is not ResponseComplete", cr.eventSkipReason(received))
+	rollback := event(200, "", uri)
+	rollback.User.Username = cr.ServiceAccount
+	assert.Equal(t, "produced by rollback", cr.eventSkipReason(rollback))
+	noRef := event(200, "", uri)
+	noRef.ObjectRef = nil
+	assert.Equal(t, "no object reference", cr.eventSkipReason(noRef))
+}
+
+func TestSkipNoOpEvents(t *testing.T) {
+	k8s := &K8sClient{
+		Client: NewClient(np1.DeepCopy()),
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	head, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+
+	raw, err := json.Marshal(np1)
+	assert.NoError(t, err, "could not marshal policy")
+	event := func(verb string, name string) auditv1.Event {
+		return auditv1.Event{
+			Stage:          auditv1.StageResponseComplete,
+			Verb:           verb,
+			User:           authnv1.UserInfo{Username: "kubernetes-admin"},
+			ObjectRef:      &auditv1.ObjectReference{Resource: "networkpolicies", Namespace: "nsA", Name: name, APIGroup: "networking.k8s.io"},
+			ResponseStatus: &metav1.Status{Code: 200},
+			ResponseObject: &runtime.Unknown{Raw: raw},
+		}
+	}
+	// a patch leaving the object unchanged and the deletion of an object that
+	// is not in the repository create no commit
+	err = cr.HandleEventList(mustMarshalEventList(t, event("patch", "npA"), event("delete", "npB")))
+	assert.NoError(t, err, "could not handle no-op events")
+	newHead, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, head.Hash(), newHead.Hash(), "no-op events committed")
+}
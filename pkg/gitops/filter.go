@@ -9,7 +9,7 @@ import (
 	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
-func (cr *CustomRepo) FilterCommits(author string, since time.Time, until time.Time, resource string, namespace string, name string) ([]object.Commit, error) {
+func (cr *CustomRepo) FilterCommits(author string, since time.Time, until time.Time, resource string, namespace string, name string, provenance ProvenanceFilter) ([]object.Commit, error) {
 	var logopts git.LogOptions
 	var filteredCommits []object.Commit
 
@@ -21,20 +21,42 @@ func (cr *CustomRepo) FilterCommits(author string, since time.Time, until time.T
 	}
 
 	logopts.From = ref.Hash()
-	if !since.IsZero() {
-		logopts.Since = &since
-	}
-	if !until.IsZero() {
-		logopts.Until = &until
-	}
 
+	notes, err := cr.readNotes()
+	if err != nil {
+		return filteredCommits, err
+	}
+	// Filter on the attribution amended by audit events received after the
+	// commit, if any.
 	filterByAuthor := func(commit *object.Commit) bool {
-		return commit.Author.Name == author
+		a, _ := attribution(commit, notes)
+		return a == author
+	}
+	// Filter on the author time, which is the time of the change in the
+	// cluster, rather than on the time the change was committed.
+	filterBySince := func(commit *object.Commit) bool {
+		return !commit.Author.When.Before(since)
+	}
+	filterByUntil := func(commit *object.Commit) bool {
+		return !commit.Author.When.After(until)
+	}
+	filterByProvenance := func(commit *object.Commit) bool {
+		_, p := attribution(commit, notes)
+		return provenance.matches(p)
 	}
 	filters := []customFilterFn{}
 	if author != "" {
 		filters = append(filters, filterByAuthor)
 	}
+	if !since.IsZero() {
+		filters = append(filters, filterBySince)
+	}
+	if !until.IsZero() {
+		filters = append(filters, filterByUntil)
+	}
+	if !provenance.empty() {
+		filters = append(filters, filterByProvenance)
+	}
 	setPathFilter(resource, namespace, name, &logopts)
 	filteredCommits, err = cr.filter(&logopts, filters...)
 	return filteredCommits, err
@@ -66,18 +88,38 @@ func (cr *CustomRepo) filter(logopts *git.LogOptions, customFilters ...customFil
 }
 
 func setPathFilter(resource string, namespace string, name string, logopts *git.LogOptions) {
+	logopts.PathFilter = pathMatcher(resource, namespace, name)
+}
+
+// pathMatcher returns a function matching repository paths against resource,
+// namespace and name glob patterns, where empty values match anything. Objects
+// of cluster-scoped resources have no namespace, so they only match without a
+// namespace, including at resource/name as stored before the _cluster
+// directory was introduced.
+func pathMatcher(resource string, namespace string, name string) func(string) bool {
 	if resource == "" {
 		resource = "*"
+	} else {
+		resource = registry.resolveDir(resource)
 	}
-	if namespace == "" {
+	anyNamespace := namespace == ""
+	if anyNamespace {
 		namespace = "*"
 	}
 	if name == "" {
 		name = "*"
 	}
 	pattern := filepath.Join(resource, namespace, name)
-	logopts.PathFilter = func(path string) bool {
-		b, _ := filepath.Match(pattern, path)
-		return b
+	legacyClusterPattern := filepath.Join(resource, name)
+	return func(path string) bool {
+		if b, _ := filepath.Match(pattern, path); b {
+			ns, _ := pathToNamespacedName(path)
+			return anyNamespace || ns != ""
+		}
+		if anyNamespace {
+			b, _ := filepath.Match(legacyClusterPattern, path)
+			return b
+		}
+		return false
 	}
 }
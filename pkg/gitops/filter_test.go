@@ -34,7 +34,7 @@ func TestFilterCommits(t *testing.T) {
 	until := time.Now()
 
 	// query by author and time range
-	commits, err := cr.FilterCommits(author, start, until, empty, empty, empty)
+	commits, err := cr.FilterCommits(author, start, until, empty, empty, empty, ProvenanceFilter{})
 	assert.NoError(t, err, "could not filter commits with time range")
 	for _, c := range commits {
 		assert.Equal(t, "kubernetes-admin", c.Author.Name, "incorrect commit author in author and time query")
@@ -42,7 +42,7 @@ func TestFilterCommits(t *testing.T) {
 	}
 
 	// query by namespace
-	commits, err = cr.FilterCommits(empty, zerotime, zerotime, empty, namespace, empty)
+	commits, err = cr.FilterCommits(empty, zerotime, zerotime, empty, namespace, empty, ProvenanceFilter{})
 	assert.NoError(t, err, "could not filter commits by namespace")
 	assert.Equal(t, 3, len(commits), "could not get the correct amount of commits")
 	for _, c := range commits {
@@ -50,10 +50,35 @@ func TestFilterCommits(t *testing.T) {
 	}
 
 	// query by resource, namespace, and name
-	commits, err = cr.FilterCommits(empty, zerotime, zerotime, resource, namespace, name)
+	commits, err = cr.FilterCommits(empty, zerotime, zerotime, resource, namespace, name, ProvenanceFilter{})
 	assert.NoError(t, err, "could not filter by resource, namespace, and name")
 	assert.Equal(t, 3, len(commits), "could not get the correct amount of commits")
 	for _, c := range commits {
 		assert.Equal(t, "kubernetes-admin", c.Author.Name, "incorrect commit author in resource, namespace, and name query")
 	}
 }
+
+func TestPathMatcher(t *testing.T) {
+	tests := []struct {
+		resource  string
+		namespace string
+		name      string
+		path      string
+		match     bool
+	}{
+		{"", "", "", "k8s-policies/nsA/npA.yaml", true},
+		{"", "", "", "antrea-tiers/_cluster/TierA.yaml", true},
+		{"", "", "", "antrea-tiers/TierA.yaml", true},
+		{"", "nsA", "", "k8s-policies/nsA/npA.yaml", true},
+		{"", "nsA", "", "k8s-policies/nsB/npA.yaml", false},
+		{"", "*", "", "antrea-tiers/_cluster/TierA.yaml", false},
+		{"", "*", "", "antrea-tiers/TierA.yaml", false},
+		{"Tier", "", "TierA.yaml", "antrea-tiers/_cluster/TierA.yaml", true},
+		{"Tier", "", "TierB.yaml", "antrea-tiers/_cluster/TierA.yaml", false},
+		{"Tier", "default", "", "antrea-tiers/_cluster/TierA.yaml", false},
+	}
+	for _, tt := range tests {
+		match := pathMatcher(tt.resource, tt.namespace, tt.name)
+		assert.Equal(t, tt.match, match(tt.path), "resource %q, namespace %q, name %q, path %s", tt.resource, tt.namespace, tt.name, tt.path)
+	}
+}
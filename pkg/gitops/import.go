@@ -0,0 +1,314 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/klog/v2"
+)
+
+// maxAuditLogLineSize bounds a line of an audit log file, which holds an Event
+// along with its request and response objects.
+const maxAuditLogLineSize = 16 * 1024 * 1024
+
+// ImportAuditLogs creates a repository in dir from the history recorded in the
+// audit log files of logDir, so that changes made before deployment can be
+// queried. Files may hold an EventList or JSON lines of Events, and may be
+// gzipped. Files of JSON lines are streamed and expected to be in stage
+// timestamp order, as written by the log backend, and their events are merged
+// in that order across all files. It returns the number of events replayed. No
+// cluster is needed, so the cluster state is only captured when the webhook is
+// later started on the repository.
+func ImportAuditLogs(mode StorageModeType, dir string, logDir string) (*CustomRepo, int, error) {
+	logs, err := openAuditLogDir(logDir)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer logs.close()
+	cr, storer, err := newCustomRepo(nil, mode, dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	r, err := cr.createRepo(storer)
+	if err == git.ErrRepositoryAlreadyExists {
+		return nil, 0, fmt.Errorf("unable to import audit logs: resource repository already exists")
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("unable to create resource repository: %w", err)
+	}
+	cr.Repo = r
+
+	read, replayed := 0, 0
+	err = logs.forEach(func(event auditv1.Event) {
+		read++
+		if event.Verb == "deletecollection" {
+			// The objects removed are only known by listing the cluster.
+			klog.InfoS("deletecollection cannot be replayed without a cluster - skipping", "auditID", event.AuditID)
+			return
+		}
+		if err := cr.handleEventList(auditv1.EventList{Items: []auditv1.Event{event}}); err != nil {
+			klog.ErrorS(err, "unable to replay audit event - skipping", "auditID", event.AuditID)
+			return
+		}
+		replayed++
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	klog.V(2).InfoS("imported audit logs", "dir", logDir, "events", read, "replayed", replayed)
+	return cr, replayed, nil
+}
+
+// auditLogStreams merges the events of several audit log files by stage
+// timestamp, holding only the next event of each file.
+type auditLogStreams []*auditLogStream
+
+// openAuditLogDir opens every audit log file in dir and reads its first event
+// that may change a resource in the repository.
+func openAuditLogDir(dir string) (*auditLogStreams, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read audit log directory %s: %w", dir, err)
+	}
+	logs := &auditLogStreams{}
+	for i, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		s, err := openAuditLogStream(filepath.Join(dir, file.Name()), i)
+		if err != nil {
+			logs.close()
+			return nil, err
+		}
+		ok, err := s.next()
+		if !ok {
+			s.close()
+		}
+		if err != nil {
+			logs.close()
+			return nil, err
+		}
+		if ok {
+			*logs = append(*logs, s)
+		}
+	}
+	heap.Init(logs)
+	return logs, nil
+}
+
+// forEach calls fn with the events of all files in stage timestamp order.
+func (logs *auditLogStreams) forEach(fn func(auditv1.Event)) error {
+	for logs.Len() > 0 {
+		s := (*logs)[0]
+		fn(s.event)
+		ok, err := s.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(logs, 0)
+		} else {
+			s.close()
+			heap.Pop(logs)
+		}
+	}
+	return nil
+}
+
+func (logs *auditLogStreams) close() {
+	for _, s := range *logs {
+		s.close()
+	}
+	*logs = nil
+}
+
+func (logs auditLogStreams) Len() int { return len(logs) }
+
+// Less orders events with the same stage timestamp by file name, then by their
+// position in the file.
+func (logs auditLogStreams) Less(i, j int) bool {
+	ti, tj := logs[i].event.StageTimestamp, logs[j].event.StageTimestamp
+	if !ti.Equal(&tj) {
+		return ti.Before(&tj)
+	}
+	return logs[i].order < logs[j].order
+}
+
+func (logs auditLogStreams) Swap(i, j int) { logs[i], logs[j] = logs[j], logs[i] }
+
+func (logs *auditLogStreams) Push(x interface{}) {
+	*logs = append(*logs, x.(*auditLogStream))
+}
+
+func (logs *auditLogStreams) Pop() interface{} {
+	old := *logs
+	s := old[len(old)-1]
+	*logs = old[:len(old)-1]
+	return s
+}
+
+// auditLogStream reads the events of an audit log file holding either an
+// EventList, as sent to the webhook, or one Event per line, as written by the
+// log backend. Lines are read one at a time, while an EventList is decoded at
+// once and sorted.
+type auditLogStream struct {
+	path string
+	// order is the position of the file in its directory.
+	order   int
+	closers []io.Closer
+	scanner *bufio.Scanner
+	line    int
+	items   []auditv1.Event
+	// event is the current event, set by next.
+	event auditv1.Event
+}
+
+func openAuditLogStream(path string, order int) (*auditLogStream, error) {
+	s := &auditLogStream{path: path, order: order}
+	reader, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	if !s.isEventList(reader) {
+		return s, s.scanLines()
+	}
+	reader, err = s.open()
+	if err != nil {
+		return nil, err
+	}
+	eventList := auditv1.EventList{}
+	if err := json.NewDecoder(reader).Decode(&eventList); err != nil {
+		klog.ErrorS(err, "unable to unmarshal audit log as an EventList, reading it as lines", "path", path)
+		return s, s.scanLines()
+	}
+	s.close()
+	sort.SliceStable(eventList.Items, func(i, j int) bool {
+		return eventList.Items[i].StageTimestamp.Before(&eventList.Items[j].StageTimestamp)
+	})
+	s.items = eventList.Items
+	return s, nil
+}
+
+// open (re)opens the file, decompressing it if gzipped and skipping a byte
+// order mark.
+func (s *auditLogStream) open() (*bufio.Reader, error) {
+	s.close()
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log %s: %w", s.path, err)
+	}
+	s.closers = append(s.closers, f)
+	var reader io.Reader = f
+	if strings.HasSuffix(s.path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("unable to decompress audit log %s: %w", s.path, err)
+		}
+		s.closers = append(s.closers, gz)
+		reader = gz
+	}
+	r := bufio.NewReader(reader)
+	if bom, err := r.Peek(3); err == nil && bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		r.Discard(3)
+	}
+	return r, nil
+}
+
+// isEventList reports whether the first line of the file is not an Event on
+// its own, as it is for an EventList spread over several lines.
+func (s *auditLogStream) isEventList(reader *bufio.Reader) bool {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxAuditLogLineSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var meta struct {
+			Kind string `json:"kind"`
+		}
+		return json.Unmarshal(line, &meta) != nil || meta.Kind == "EventList"
+	}
+	return false
+}
+
+// scanLines reads the file from the start as one Event per line.
+func (s *auditLogStream) scanLines() error {
+	reader, err := s.open()
+	if err != nil {
+		return err
+	}
+	s.scanner = bufio.NewScanner(reader)
+	s.scanner.Buffer(make([]byte, 0, 64*1024), maxAuditLogLineSize)
+	s.line = 0
+	return nil
+}
+
+// next moves to the following event that may change a resource in the
+// repository, and reports whether there was one.
+func (s *auditLogStream) next() (bool, error) {
+	if s.scanner == nil {
+		for len(s.items) > 0 {
+			s.event, s.items = s.items[0], s.items[1:]
+			if isAuditedEvent(s.event) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	for s.scanner.Scan() {
+		s.line++
+		line := bytes.TrimSpace(s.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		event := auditv1.Event{}
+		if err := json.Unmarshal(line, &event); err != nil {
+			klog.ErrorS(err, "unable to unmarshal audit log line - skipping", "path", s.path, "line", s.line)
+			continue
+		}
+		if isAuditedEvent(event) {
+			s.event = event
+			return true, nil
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return false, fmt.Errorf("unable to read audit log %s: %w", s.path, err)
+	}
+	return false, nil
+}
+
+func (s *auditLogStream) close() {
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		s.closers[i].Close()
+	}
+	s.closers = nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+func TestImportAuditLogs(t *testing.T) {
+	logDir := t.TempDir()
+	repoDir := t.TempDir()
+	lines := auditLogLines(t, "../../test/files/correct-audit-log.txt")
+	// the events of each file are in order, but interleave across files
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(logDir, "audit-1.log"), lines[2], 0600))
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write(append(lines[0], lines[1]...))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(logDir, "audit-2.log.gz"), compressed.Bytes(), 0600))
+
+	cr, replayed, err := ImportAuditLogs(StorageModeDisk, repoDir, logDir)
+	assert.NoError(t, err, "could not import audit logs")
+	assert.Equal(t, 3, replayed)
+	commits, err := cr.Repo.Log(&git.LogOptions{})
+	assert.NoError(t, err, "unable to get repo log")
+	var messages []string
+	assert.NoError(t, commits.ForEach(func(c *object.Commit) error {
+		message, _ := ParseProvenance(c.Message)
+		messages = append(messages, message)
+		return nil
+	}))
+	assert.Equal(t, []string{
+		"Updated K8s network policy default/allow-client1",
+		"Deleted K8s network policy default/allow-client1",
+		"Created K8s network policy default/allow-client1",
+	}, messages)
+
+	// the fixture holding an EventList is accepted as well
+	eventListDir := t.TempDir()
+	jsonstring, err := ioutil.ReadFile("../../test/files/correct-audit-log.txt")
+	assert.NoError(t, err, "could not read mock audit log")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(eventListDir, "audit.json"), jsonstring, 0600))
+	assert.Equal(t, 3, countAuditLogEvents(t, eventListDir))
+
+	// lines longer than the default scanner buffer are read whole
+	longLineDir := t.TempDir()
+	event := auditv1.Event{}
+	assert.NoError(t, json.Unmarshal(lines[0], &event))
+	event.Annotations = map[string]string{"padding": strings.Repeat("x", 128*1024)}
+	longLine, err := json.Marshal(event)
+	assert.NoError(t, err, "could not marshal audit event")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(longLineDir, "audit.log"), append(longLine, '\n'), 0600))
+	assert.Equal(t, 1, countAuditLogEvents(t, longLineDir))
+
+	_, _, err = ImportAuditLogs(StorageModeDisk, repoDir, logDir)
+	assert.Error(t, err, "should not import into an existing repository")
+}
+
+func countAuditLogEvents(t *testing.T, dir string) int {
+	logs, err := openAuditLogDir(dir)
+	if !assert.NoError(t, err, "could not open audit logs") {
+		return 0
+	}
+	defer logs.close()
+	count := 0
+	assert.NoError(t, logs.forEach(func(auditv1.Event) { count++ }), "could not read audit logs")
+	return count
+}
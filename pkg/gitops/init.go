@@ -15,6 +15,7 @@
 package gitops
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -29,8 +30,8 @@ import (
 	"github.com/go-git/go-git/v5/storage"
 	"github.com/go-git/go-git/v5/storage/filesystem"
 	memory "github.com/go-git/go-git/v5/storage/memory"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/klog/v2"
 )
 
@@ -41,58 +42,24 @@ const (
 	StorageModeInMemory StorageModeType = "InMemory"
 )
 
-var gvkDirMap = map[schema.GroupVersionKind]string{
-	{Group: "networking.k8s.io",
-		Version: "v1",
-		Kind:    "NetworkPolicyList",
-	}: "k8s-policies",
-	{Group: "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "NetworkPolicyList",
-	}: "antrea-policies",
-	{Group: "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "ClusterNetworkPolicyList",
-	}: "antrea-cluster-policies",
-	{Group: "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "TierList",
-	}: "antrea-tiers",
+var errResourceTypeNotServed = errors.New("resource type not served by cluster")
+
+// isNoMatchError reports whether err was caused by the cluster not serving a
+// kind, e.g. because the corresponding CRD is not installed.
+func isNoMatchError(err error) bool {
+	var kindErr *meta.NoKindMatchError
+	var resourceErr *meta.NoResourceMatchError
+	return errors.As(err, &kindErr) || errors.As(err, &resourceErr)
 }
 
 func GetResources() []string {
 	var resources []string
-	for _, resource := range gvkDirMap {
-		resources = append(resources, resource)
+	for _, rt := range registry.Types {
+		resources = append(resources, rt.Dir)
 	}
 	return resources
 }
 
-func getAllResourceListTypes() []schema.GroupVersionKind {
-	return []schema.GroupVersionKind{
-		{
-			Group:   "networking.k8s.io",
-			Version: "v1",
-			Kind:    "NetworkPolicyList",
-		},
-		{
-			Group:   "crd.antrea.io",
-			Version: "v1alpha1",
-			Kind:    "NetworkPolicyList",
-		},
-		{
-			Group:   "crd.antrea.io",
-			Version: "v1alpha1",
-			Kind:    "ClusterNetworkPolicyList",
-		},
-		{
-			Group:   "crd.antrea.io",
-			Version: "v1alpha1",
-			Kind:    "TierList",
-		},
-	}
-}
-
 type CustomRepo struct {
 	Repo           *git.Repository
 	K8s            *K8sClient
@@ -100,30 +67,57 @@ type CustomRepo struct {
 	ServiceAccount string
 	Fs             billy.Filesystem
 	Mutex          sync.Mutex
+	rollbackJobs   rollbackJobs
+	// rollbackMutex serializes rollbacks and reverts, which only hold Mutex
+	// while they read or write the repository.
+	rollbackMutex sync.Mutex
+	eventQueue    *eventQueue
+	// deadLetters holds the event lists that could not be committed.
+	deadLetters *eventQueue
+	// queueAttempts counts the failed attempts to handle the list at the head
+	// of eventQueue.
+	queueAttempts int
+	// queued wakes up the event worker when an event list is queued.
+	queued   chan struct{}
+	auditIDs *auditIDSet
+	// stateFs holds the event queue, the committed audit IDs and the position
+	// in ingested audit log files.
+	stateFs billy.Filesystem
+	// unattributed holds the changes committed from watch events that are
+	// waiting for their audit event, by path.
+	unattributed map[string][]pendingAttribution
 }
 
 func SetupRepo(k8s *K8sClient, mode StorageModeType, dir string) (*CustomRepo, error) {
-	storer, fs, err := setupStorage(dir, mode)
+	cr, storer, err := newCustomRepo(k8s, mode, dir)
 	if err != nil {
-		return nil, fmt.Errorf("unable to set up filesystem/storer backend for repo")
-	}
-	svcAcct := "system:serviceaccount:" + GetAuditPodNamespace() + ":" + GetAuditServiceAccount()
-	cr := CustomRepo{
-		K8s:            k8s,
-		RollbackMode:   false,
-		ServiceAccount: svcAcct,
-		Fs:             fs,
+		return nil, err
 	}
 	cr.Mutex.Lock()
 	defer cr.Mutex.Unlock()
 	r, err := cr.createRepo(storer)
 	cr.Repo = r
 	if err == git.ErrRepositoryAlreadyExists {
-		klog.V(2).InfoS("resource repository already exists - skipping initialization")
-		return &cr, nil
+		if err := cr.migrateClusterScopedLayout(); err != nil {
+			return nil, fmt.Errorf("unable to migrate existing repository: %w", err)
+		}
+		if err := cr.loadPendingAttributions(); err != nil {
+			return nil, fmt.Errorf("unable to load unattributed changes: %w", err)
+		}
+		// Events queued before a restart predate the current cluster state, so
+		// commit them before reconciling
+		cr.drainEventQueue()
+		klog.V(2).InfoS("resource repository already exists - reconciling with cluster state")
+		if err := cr.reconcile(); err != nil {
+			return nil, fmt.Errorf("unable to reconcile existing repository: %w", err)
+		}
+		return cr, nil
 	} else if err != nil {
 		return nil, fmt.Errorf("unable to create resource repository: %w", err)
 	}
+	if err := cr.eventQueue.reset(); err != nil {
+		return nil, fmt.Errorf("unable to clear event queue: %w", err)
+	}
 	if err := cr.addAllResources(); err != nil {
 		return nil, fmt.Errorf("unable to add resource yamls to repository: %w", err)
 	}
@@ -131,7 +125,35 @@ func SetupRepo(k8s *K8sClient, mode StorageModeType, dir string) (*CustomRepo, e
 		return nil, fmt.Errorf("unable to add/commit existing reosurces to repository: %w", err)
 	}
 	klog.V(2).Infof("repository successfully initialized at %s", dir)
-	return &cr, nil
+	return cr, nil
+}
+
+// newCustomRepo sets up the storage of a repository without opening or
+// creating it.
+func newCustomRepo(k8s *K8sClient, mode StorageModeType, dir string) (*CustomRepo, storage.Storer, error) {
+	storer, fs, err := setupStorage(dir, mode)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to set up filesystem/storer backend for repo")
+	}
+	queueFs := setupQueueStorage(dir, mode)
+	auditIDs, err := loadAuditIDSet(queueFs, "processed-audit-ids")
+	if err != nil {
+		return nil, nil, err
+	}
+	svcAcct := "system:serviceaccount:" + GetAuditPodNamespace() + ":" + GetAuditServiceAccount()
+	cr := &CustomRepo{
+		K8s:            k8s,
+		RollbackMode:   false,
+		ServiceAccount: svcAcct,
+		Fs:             fs,
+		eventQueue:     newEventQueue(queueFs, "audit-queue"),
+		deadLetters:    newEventQueue(queueFs, "audit-dead-letters"),
+		queued:         make(chan struct{}, 1),
+		auditIDs:       auditIDs,
+		stateFs:        queueFs,
+		unattributed:   map[string][]pendingAttribution{},
+	}
+	return cr, storer, nil
 }
 
 func setupStorage(dir string, mode StorageModeType) (storage.Storer, billy.Filesystem, error) {
@@ -154,6 +176,19 @@ func setupStorage(dir string, mode StorageModeType) (storage.Storer, billy.Files
 	return storer, worktreeFs, nil
 }
 
+// setupQueueStorage returns the filesystem holding the queue of audit events not
+// yet committed and the IDs of those already committed, kept next to the
+// repository rather than in its worktree.
+func setupQueueStorage(dir string, mode StorageModeType) billy.Filesystem {
+	if mode == StorageModeDisk {
+		if dir == "" {
+			dir, _ = os.Getwd()
+		}
+		return osfs.New(filepath.Join(dir, "resource-auditing-queue"))
+	}
+	return memfs.New()
+}
+
 func (cr *CustomRepo) createRepo(storer storage.Storer) (*git.Repository, error) {
 	r, err := git.Init(storer, cr.Fs)
 	if err == git.ErrRepositoryAlreadyExists {
@@ -166,49 +201,69 @@ func (cr *CustomRepo) createRepo(storer storage.Storer) (*git.Repository, error)
 }
 
 func (cr *CustomRepo) addAllResources() error {
-	for _, resourceListType := range getAllResourceListTypes() {
-		if err := cr.createResourceDir(resourceListType); err != nil {
-			return fmt.Errorf("unable to create directory for resource type %s: %w", resourceListType.String(), err)
+	for _, resourceType := range registry.Types {
+		if err := cr.createResourceDir(resourceType); err != nil {
+			return fmt.Errorf("unable to create directory for resource type %s: %w", resourceType.GroupVersionKind().String(), err)
+		}
+		if err := cr.addResource(resourceType); err != nil {
+			return fmt.Errorf("unable to add resources for type %s: %w", resourceType.GroupVersionKind().String(), err)
 		}
-		if err := cr.addResource(resourceListType); err != nil {
-			return fmt.Errorf("unable to add resources for type %s: %w", resourceListType.String(), err)
+	}
+	return nil
+}
+
+func (cr *CustomRepo) addResource(resourceType ResourceType) error {
+	files, err := cr.getResourceFiles(resourceType)
+	if errors.Is(err, errResourceTypeNotServed) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for path, y := range files {
+		if err := cr.writeFileToPath(path, y); err != nil {
+			return fmt.Errorf("could not write yaml to path %s: %w", path, err)
 		}
+		klog.V(2).InfoS("added resource", "path", path)
 	}
 	return nil
 }
 
-func (cr *CustomRepo) addResource(resourceList schema.GroupVersionKind) error {
+// getResourceFiles lists all resources of the given type from the cluster and
+// returns their YAML representation keyed by repository path.
+func (cr *CustomRepo) getResourceFiles(resourceType ResourceType) (map[string][]byte, error) {
 	list := &unstructured.UnstructuredList{}
-	list.SetGroupVersionKind(resourceList)
+	list.SetGroupVersionKind(resourceType.ListGroupVersionKind())
 	resources, err := cr.K8s.ListResource(list)
-	if err != nil {
-		return fmt.Errorf("could not list resource APIVersion: %s Kind: %s: %w", list.GetAPIVersion(), list.GetKind(), err)
+	if isNoMatchError(err) {
+		klog.V(2).InfoS("resource type not served by cluster - skipping", "apiVersion", list.GetAPIVersion(), "kind", resourceType.Kind)
+		return nil, errResourceTypeNotServed
+	} else if err != nil {
+		return nil, fmt.Errorf("could not list resource APIVersion: %s Kind: %s: %w", list.GetAPIVersion(), list.GetKind(), err)
 	}
+	files := map[string][]byte{}
 	var namespaces []string
 	for i, np := range resources.Items {
-		clearFields(&resources.Items[i])
+		normalizeResource(&resources.Items[i])
+		redactResource(&resources.Items[i])
 		name := np.GetName()
-		namespace := np.GetNamespace()
+		namespace := namespaceDir(resourceType, np.GetNamespace())
 		if !stringInSlice(namespace, namespaces) {
 			namespaces = append(namespaces, namespace)
-			namespaceDir := computePath("", gvkDirMap[resourceList], namespace, "")
-			cr.Fs.MkdirAll(namespaceDir, 0700)
+			dir := computePath("", resourceType.Dir, namespace, "")
+			cr.Fs.MkdirAll(dir, 0700)
 		}
-		path := computePath("", gvkDirMap[resourceList], namespace, name+".yaml")
+		path := computePath("", resourceType.Dir, namespace, name+".yaml")
 		y, err := yaml.Marshal(&resources.Items[i])
 		if err != nil {
-			return fmt.Errorf("could not marshal resource config: %w", err)
-		}
-		if err := cr.writeFileToPath(path, y); err != nil {
-			return fmt.Errorf("could not write yaml to path %s: %w", path, err)
+			return nil, fmt.Errorf("could not marshal resource config: %w", err)
 		}
-		klog.V(2).InfoS("added resource", "path", path)
+		files[path] = y
 	}
-	return nil
+	return files, nil
 }
 
-func (cr *CustomRepo) createResourceDir(resourceList schema.GroupVersionKind) error {
-	resourceDir := computePath("", gvkDirMap[resourceList], "", "")
+func (cr *CustomRepo) createResourceDir(resourceType ResourceType) error {
+	resourceDir := computePath("", resourceType.Dir, "", "")
 	err := cr.Fs.MkdirAll(resourceDir, 0700)
 	if err != nil {
 		return fmt.Errorf("unable to create resource directory: %w", err)
@@ -21,6 +21,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -62,8 +63,6 @@ spec:
   ingress:
   - {}
   podSelector: {}
-  policyTypes:
-  - Ingress
 `,
 	}
 	Np2 = test_resource{
@@ -288,7 +287,7 @@ spec:
 				},
 			},
 		},
-		expPath: "/antrea-cluster-policies/cnpA.yaml",
+		expPath: "/antrea-cluster-policies/_cluster/cnpA.yaml",
 		expYaml: `apiVersion: crd.antrea.io/v1alpha1
 kind: ClusterNetworkPolicy
 metadata:
@@ -340,7 +339,7 @@ spec:
 				Description: "This is a test tier",
 			},
 		},
-		expPath: "/antrea-tiers/TierA.yaml",
+		expPath: "/antrea-tiers/_cluster/TierA.yaml",
 		expYaml: `apiVersion: crd.antrea.io/v1alpha1
 kind: Tier
 metadata:
@@ -348,6 +347,89 @@ metadata:
 spec:
   description: This is a test tier
   priority: 10
+`,
+	}
+	Cg1 = test_resource{
+		inputResource: &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "crd.antrea.io/v1alpha3",
+			"kind":       "ClusterGroup",
+			"metadata":   map[string]interface{}{"name": "cgA", "uid": "uidE"},
+			"spec": map[string]interface{}{
+				"podSelector": map[string]interface{}{"matchLabels": map[string]interface{}{"foo1": "bar1"}},
+			},
+		}},
+		expPath: "/antrea-cluster-groups/_cluster/cgA.yaml",
+		expYaml: `apiVersion: crd.antrea.io/v1alpha3
+kind: ClusterGroup
+metadata:
+  name: cgA
+spec:
+  podSelector:
+    matchLabels:
+      foo1: bar1
+`,
+	}
+	Grp1 = test_resource{
+		inputResource: &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "crd.antrea.io/v1alpha3",
+			"kind":       "Group",
+			"metadata":   map[string]interface{}{"namespace": "nsA", "name": "grpA"},
+			"spec": map[string]interface{}{
+				"childGroups": []interface{}{"grpB"},
+			},
+		}},
+		expPath: "/antrea-groups/nsA/grpA.yaml",
+		expYaml: `apiVersion: crd.antrea.io/v1alpha3
+kind: Group
+metadata:
+  name: grpA
+  namespace: nsA
+spec:
+  childGroups:
+  - grpB
+`,
+	}
+	Egress1 = test_resource{
+		inputResource: &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "crd.antrea.io/v1alpha2",
+			"kind":       "Egress",
+			"metadata":   map[string]interface{}{"name": "egressA"},
+			"spec": map[string]interface{}{
+				"appliedTo":      map[string]interface{}{"podSelector": map[string]interface{}{"matchLabels": map[string]interface{}{"foo1": "bar1"}}},
+				"externalIPPool": "poolA",
+			},
+			"status": map[string]interface{}{"egressNode": "node1"},
+		}},
+		expPath: "/antrea-egresses/_cluster/egressA.yaml",
+		expYaml: `apiVersion: crd.antrea.io/v1alpha2
+kind: Egress
+metadata:
+  name: egressA
+spec:
+  appliedTo:
+    podSelector:
+      matchLabels:
+        foo1: bar1
+  externalIPPool: poolA
+`,
+	}
+	Pool1 = test_resource{
+		inputResource: &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "crd.antrea.io/v1alpha2",
+			"kind":       "ExternalIPPool",
+			"metadata":   map[string]interface{}{"name": "poolA"},
+			"spec": map[string]interface{}{
+				"ipRanges": []interface{}{map[string]interface{}{"cidr": "10.10.0.0/24"}},
+			},
+		}},
+		expPath: "/antrea-external-ip-pools/_cluster/poolA.yaml",
+		expYaml: `apiVersion: crd.antrea.io/v1alpha2
+kind: ExternalIPPool
+metadata:
+  name: poolA
+spec:
+  ipRanges:
+  - cidr: 10.10.0.0/24
 `,
 	}
 )
@@ -377,6 +459,10 @@ func TestSetupRepo(t *testing.T) {
 			name:           "tiers-test",
 			inputResources: []test_resource{Np1, Np2, Anp1, Tier1},
 		},
+		{
+			name:           "groups-egress-test",
+			inputResources: []test_resource{Acnp1, Cg1, Grp1, Egress1, Pool1},
+		},
 	}
 	for _, test := range tests {
 		var expectedPaths = []string{}
@@ -0,0 +1,145 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"k8s.io/klog/v2"
+)
+
+// migrateClusterScopedLayout moves the files of cluster-scoped resources from
+// resource/name.yaml, where earlier versions stored them, to
+// resource/_cluster/name.yaml, and commits the move. Mutex must be held.
+func (cr *CustomRepo) migrateClusterScopedLayout() error {
+	var moved []string
+	for _, resourceType := range registry.Types {
+		if resourceType.Namespaced {
+			continue
+		}
+		infos, err := cr.Fs.ReadDir(resourceType.Dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("unable to read directory %s: %w", resourceType.Dir, err)
+		}
+		for _, info := range infos {
+			if info.IsDir() || filepath.Ext(info.Name()) != ".yaml" {
+				continue
+			}
+			oldPath := computePath("", resourceType.Dir, "", info.Name())
+			newPath := computePath("", resourceType.Dir, clusterScopeDir, info.Name())
+			y, err := util.ReadFile(cr.Fs, oldPath)
+			if err != nil {
+				return fmt.Errorf("unable to read file at %s: %w", oldPath, err)
+			}
+			if err := cr.writeFileToPath(newPath, y); err != nil {
+				return fmt.Errorf("could not write yaml to path %s: %w", newPath, err)
+			}
+			if err := cr.removePath(oldPath); err != nil {
+				return err
+			}
+			moved = append(moved, oldPath+" -> "+newPath)
+		}
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+	message := "Move cluster-scoped resources to " + clusterScopeDir + " directories\n" + formatPathList("Moved", moved)
+	if err := cr.AddAndCommit("audit-init", "system@audit.antrea.io", message); err != nil {
+		return fmt.Errorf("unable to add/commit cluster-scoped resource migration: %w", err)
+	}
+	klog.V(2).InfoS("moved cluster-scoped resources to new repository layout", "count", len(moved))
+	return nil
+}
+
+// clusterScopedPath maps the path of a cluster-scoped resource in the layout
+// of earlier versions, resource/name.yaml, to resource/_cluster/name.yaml.
+// Other paths are returned unchanged.
+func clusterScopedPath(path string) string {
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		return path
+	}
+	resourceType, ok := registry.ByDir(parts[0])
+	if !ok || resourceType.Namespaced {
+		return path
+	}
+	return computePath("", parts[0], clusterScopeDir, parts[1])
+}
+
+// diffMigratedTrees returns the changes between two trees, with the paths of
+// cluster-scoped resources mapped to the current layout. A file moved by
+// migrateClusterScopedLayout is thus a single change, or none if its content
+// is the same, rather than the deletion of one path and the creation of the
+// other.
+func diffMigratedTrees(from *object.Tree, to *object.Tree) (object.Changes, error) {
+	changes, err := object.DiffTree(from, to)
+	if err != nil {
+		return nil, err
+	}
+	var migrated object.Changes
+	byPath := map[string]int{}
+	for _, change := range changes {
+		change.From.Name = clusterScopedPath(change.From.Name)
+		change.To.Name = clusterScopedPath(change.To.Name)
+		path := change.To.Name
+		if path == "" {
+			path = change.From.Name
+		}
+		i, ok := byPath[path]
+		if !ok {
+			byPath[path] = len(migrated)
+			migrated = append(migrated, change)
+			continue
+		}
+		// Merge the deletion and the creation of the same path
+		if change.From == (object.ChangeEntry{}) {
+			migrated[i].To = change.To
+		} else {
+			migrated[i].From = change.From
+		}
+	}
+	var filtered object.Changes
+	for _, change := range migrated {
+		if change.From.TreeEntry.Hash != change.To.TreeEntry.Hash {
+			filtered = append(filtered, change)
+		}
+	}
+	return filtered, nil
+}
+
+// migratedPatch returns the patch between two commits, with the paths of
+// cluster-scoped resources mapped to the current layout.
+func migratedPatch(from *object.Commit, to *object.Commit) (*object.Patch, error) {
+	fromTree, err := from.Tree()
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := diffMigratedTrees(fromTree, toTree)
+	if err != nil {
+		return nil, err
+	}
+	return changes.Patch()
+}
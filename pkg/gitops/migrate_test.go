@@ -0,0 +1,120 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	crdv1alpha1 "antrea.io/antrea/pkg/apis/crd/v1alpha1"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"antrea.io/resource-auditing/pkg/types"
+)
+
+func TestMigrateClusterScopedLayout(t *testing.T) {
+	k8s := &K8sClient{
+		Client: NewClient(np1.DeepCopy()),
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+
+	// Lay out a tier as stored by earlier versions
+	legacyPath := "antrea-tiers/TierA.yaml"
+	assert.NoError(t, cr.writeFileToPath(legacyPath, []byte(Tier1.expYaml)))
+	assert.NoError(t, cr.AddAndCommit("audit-init", "system@audit.antrea.io", "Add legacy tier"))
+
+	cr.Mutex.Lock()
+	err = cr.migrateClusterScopedLayout()
+	cr.Mutex.Unlock()
+	assert.NoError(t, err, "unable to migrate repository")
+	_, err = cr.Fs.Stat(legacyPath)
+	assert.True(t, os.IsNotExist(err), "legacy file not removed")
+	y, err := util.ReadFile(cr.Fs, "antrea-tiers/_cluster/TierA.yaml")
+	assert.NoError(t, err, "tier not moved to the _cluster directory")
+	assert.Equal(t, Tier1.expYaml, string(y))
+	assert.Contains(t, headMessage(t, cr), "antrea-tiers/TierA.yaml -> antrea-tiers/_cluster/TierA.yaml")
+	w, err := cr.Repo.Worktree()
+	assert.NoError(t, err, "unable to get worktree")
+	status, err := w.Status()
+	assert.NoError(t, err, "unable to get worktree status")
+	assert.True(t, status.IsClean(), "migration left uncommitted changes")
+
+	// Migrating again is a no-op
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	cr.Mutex.Lock()
+	err = cr.migrateClusterScopedLayout()
+	cr.Mutex.Unlock()
+	assert.NoError(t, err, "unable to migrate migrated repository")
+	h2, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, h.Hash(), h2.Hash(), "migration of a migrated repository committed")
+}
+
+func TestRollbackAcrossMigration(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+
+	// Commit a tier as stored by earlier versions, then migrate
+	tier := Tier1.inputResource.(*crdv1alpha1.Tier).DeepCopy()
+	tier.ResourceVersion = ""
+	assert.NoError(t, fakeClient.Create(context.TODO(), tier))
+	legacyPath := "antrea-tiers/TierA.yaml"
+	assert.NoError(t, cr.writeFileToPath(legacyPath, []byte(Tier1.expYaml)))
+	assert.NoError(t, cr.AddAndCommit("audit-init", "system@audit.antrea.io", "Add legacy tier"))
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	target, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get target commit")
+	cr.Mutex.Lock()
+	err = cr.migrateClusterScopedLayout()
+	cr.Mutex.Unlock()
+	assert.NoError(t, err, "unable to migrate repository")
+
+	tier.Spec.Priority = 20
+	assert.NoError(t, fakeClient.Update(context.TODO(), tier))
+	assert.NoError(t, cr.Reconcile(), "unable to record tier update")
+
+	// The tier is updated in place rather than deleted and created again
+	plan, err := cr.PlanRollback(target, RollbackOptions{})
+	assert.NoError(t, err, "unable to plan rollback across migration")
+	assert.Len(t, plan.Items, 1)
+	for _, item := range plan.Items {
+		assert.Equal(t, types.RollbackUpdate, item.Action)
+		assert.Equal(t, "antrea-tiers/_cluster/TierA.yaml", item.Path)
+	}
+
+	recording := &recordingClient{Client: fakeClient}
+	cr.K8s = &K8sClient{Client: recording}
+	_, err = cr.RollbackRepo(target, RollbackOptions{})
+	assert.NoError(t, err, "unable to roll back across migration")
+	assert.NotContains(t, recording.names, "delete TierA", "tier deleted by rollback")
+	_, err = cr.Fs.Stat(legacyPath)
+	assert.True(t, os.IsNotExist(err), "rollback restored legacy path")
+	y, err := util.ReadFile(cr.Fs, "antrea-tiers/_cluster/TierA.yaml")
+	assert.NoError(t, err, "tier not found in the _cluster directory")
+	assert.Equal(t, Tier1.expYaml, string(y))
+	rolledBack := &crdv1alpha1.Tier{}
+	assert.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(tier), rolledBack))
+	assert.Equal(t, int32(10), rolledBack.Spec.Priority)
+}
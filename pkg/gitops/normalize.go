@@ -0,0 +1,434 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// NormalizationConfig lists the rules applied, in order, to objects before they
+// are written to the repository, so that files hold what users configured
+// rather than what the API server added.
+type NormalizationConfig struct {
+	Rules []NormalizationRule `json:"rules"`
+}
+
+// NormalizationRule applies to objects of the given Group and Kind, or to all
+// objects when both are empty. Field paths are JSONPath-style, e.g.
+// .spec.ingress[*].ports or .metadata.annotations['example.com/key'], where *
+// matches every list element or map entry.
+type NormalizationRule struct {
+	Group       string         `json:"group,omitempty"`
+	Kind        string         `json:"kind,omitempty"`
+	Drop        []string       `json:"drop,omitempty"`
+	Defaults    []DefaultValue `json:"defaults,omitempty"`
+	Labels      *KeyFilter     `json:"labels,omitempty"`
+	Annotations *KeyFilter     `json:"annotations,omitempty"`
+}
+
+// DefaultValue is a value set by the API server when a field is omitted. The
+// field is dropped when it holds Value, the fields of When are set and the
+// fields of Unless are not, i.e. when omitting it would yield the same object.
+type DefaultValue struct {
+	Path   string      `json:"path"`
+	Value  interface{} `json:"value"`
+	When   []string    `json:"when,omitempty"`
+	Unless []string    `json:"unless,omitempty"`
+}
+
+// KeyFilter selects label or annotation keys. Keys are kept when they match
+// Allow, or Allow is empty, and do not match Deny. Patterns are exact keys or
+// prefixes ending with *.
+type KeyFilter struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+var defaultNormalizationRules = []NormalizationRule{
+	{
+		Drop: []string{
+			".metadata.uid",
+			".metadata.generation",
+			".metadata.managedFields",
+			".metadata.creationTimestamp",
+			".metadata.resourceVersion",
+			".status",
+		},
+		Annotations: &KeyFilter{
+			Deny: []string{"kubectl.kubernetes.io/last-applied-configuration"},
+		},
+	},
+	{
+		Group: "networking.k8s.io",
+		Kind:  "NetworkPolicy",
+		Defaults: []DefaultValue{
+			{Path: ".spec.policyTypes", Value: []interface{}{"Ingress"}, Unless: []string{".spec.egress"}},
+			{Path: ".spec.policyTypes", Value: []interface{}{"Ingress", "Egress"}, When: []string{".spec.egress"}},
+		},
+	},
+}
+
+var normalization = DefaultNormalizationConfig()
+
+func DefaultNormalizationConfig() *NormalizationConfig {
+	c := &NormalizationConfig{}
+	j, _ := json.Marshal(defaultNormalizationRules)
+	json.Unmarshal(j, &c.Rules)
+	return c
+}
+
+// LoadNormalizationConfig reads a YAML or JSON file with a top-level rules list,
+// replacing the default normalization.
+func LoadNormalizationConfig(path string) (*NormalizationConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read normalization config file: %w", err)
+	}
+	c := &NormalizationConfig{}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal normalization config: %w", err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid normalization config %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// SetNormalizationConfig replaces the normalization used by the package. It
+// must be called before the repository is set up.
+func SetNormalizationConfig(c *NormalizationConfig) {
+	normalization = c
+}
+
+func (c *NormalizationConfig) validate() error {
+	for _, rule := range c.Rules {
+		paths := append([]string(nil), rule.Drop...)
+		for _, d := range rule.Defaults {
+			if d.Value == nil {
+				return fmt.Errorf("default of %s has no value", d.Path)
+			}
+			paths = append(paths, d.Path)
+			paths = append(paths, d.When...)
+			paths = append(paths, d.Unless...)
+		}
+		for _, p := range paths {
+			if _, err := parseFieldPath(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeResource applies the normalization rules to an object, then drops
+// labels and annotations left empty.
+func normalizeResource(resource *unstructured.Unstructured) {
+	gvk := resource.GroupVersionKind()
+	for _, rule := range normalization.Rules {
+		if (rule.Group != "" || rule.Kind != "") && (rule.Group != gvk.Group || rule.Kind != gvk.Kind) {
+			continue
+		}
+		for _, p := range rule.Drop {
+			path, _ := parseFieldPath(p)
+			removeFields(resource.Object, path, func(interface{}) bool { return true })
+		}
+		for _, d := range rule.Defaults {
+			if !d.applies(resource.Object) {
+				continue
+			}
+			path, _ := parseFieldPath(d.Path)
+			removeFields(resource.Object, path, func(value interface{}) bool { return jsonEqual(value, d.Value) })
+		}
+		if rule.Labels != nil {
+			resource.SetLabels(rule.Labels.filter(resource.GetLabels()))
+		}
+		if rule.Annotations != nil {
+			resource.SetAnnotations(rule.Annotations.filter(resource.GetAnnotations()))
+		}
+	}
+	if len(resource.GetLabels()) == 0 {
+		unstructured.RemoveNestedField(resource.Object, "metadata", "labels")
+	}
+	if len(resource.GetAnnotations()) == 0 {
+		unstructured.RemoveNestedField(resource.Object, "metadata", "annotations")
+	}
+}
+
+// restoreNormalizedFields copies the fields dropped by normalization, and the
+// labels and annotations filtered out by it, from the live object to a resource
+// read from the repository, so that a rollback, which replaces the whole
+// object, does not clear them. Defaults are left to the API server.
+func (cr *CustomRepo) restoreNormalizedFields(resource *unstructured.Unstructured) error {
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(resource.GroupVersionKind())
+	live, err := cr.K8s.GetResource(live, resource.GetNamespace(), resource.GetName())
+	if errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to get live state of resource %s: %w", resource.GetName(), err)
+	}
+	mergeNormalizedFields(resource, live)
+	// CreateOrUpdateResource tries a create first, which takes no version
+	unstructured.RemoveNestedField(resource.Object, "metadata", "resourceVersion")
+	return nil
+}
+
+// mergeNormalizedFields copies the fields of live removed by normalizeResource,
+// other than defaults, to resource where it does not set them.
+func mergeNormalizedFields(resource *unstructured.Unstructured, live *unstructured.Unstructured) {
+	gvk := resource.GroupVersionKind()
+	for _, rule := range normalization.Rules {
+		if (rule.Group != "" || rule.Kind != "") && (rule.Group != gvk.Group || rule.Kind != gvk.Kind) {
+			continue
+		}
+		for _, p := range rule.Drop {
+			path, _ := parseFieldPath(p)
+			copyFields(resource.Object, live.Object, path)
+		}
+		if rule.Labels != nil {
+			resource.SetLabels(mergeFilteredKeys(rule.Labels, resource.GetLabels(), live.GetLabels()))
+		}
+		if rule.Annotations != nil {
+			resource.SetAnnotations(mergeFilteredKeys(rule.Annotations, resource.GetAnnotations(), live.GetAnnotations()))
+		}
+	}
+	if len(resource.GetLabels()) == 0 {
+		unstructured.RemoveNestedField(resource.Object, "metadata", "labels")
+	}
+	if len(resource.GetAnnotations()) == 0 {
+		unstructured.RemoveNestedField(resource.Object, "metadata", "annotations")
+	}
+}
+
+// mergeFilteredKeys adds the keys of live removed by the filter to m.
+func mergeFilteredKeys(f *KeyFilter, m map[string]string, live map[string]string) map[string]string {
+	kept := f.filter(live)
+	for k, v := range live {
+		if _, ok := kept[k]; ok {
+			continue
+		}
+		if m == nil {
+			m = map[string]string{}
+		}
+		if _, ok := m[k]; !ok {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func (d DefaultValue) applies(object map[string]interface{}) bool {
+	for _, p := range d.When {
+		if path, _ := parseFieldPath(p); !fieldSet(object, path) {
+			return false
+		}
+	}
+	for _, p := range d.Unless {
+		if path, _ := parseFieldPath(p); fieldSet(object, path) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *KeyFilter) filter(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	filtered := map[string]string{}
+	for k, v := range m {
+		if (len(f.Allow) == 0 || matchesKey(f.Allow, k)) && !matchesKey(f.Deny, k) {
+			filtered[k] = v
+		}
+	}
+	return filtered
+}
+
+func matchesKey(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if p == key || (strings.HasSuffix(p, "*") && strings.HasPrefix(key, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFieldPath splits a JSONPath-style field path into its segments, where
+// [*] and .* become a * segment.
+func parseFieldPath(path string) ([]string, error) {
+	var segments []string
+	rest := strings.TrimPrefix(path, ".")
+	for rest != "" {
+		var segment string
+		if strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in field path %s", path)
+			}
+			segment = strings.Trim(rest[1:end], `'"`)
+			rest = rest[end+1:]
+		} else {
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			segment = rest[:end]
+			rest = rest[end:]
+		}
+		if segment == "" {
+			return nil, fmt.Errorf("empty segment in field path %s", path)
+		}
+		segments = append(segments, segment)
+		rest = strings.TrimPrefix(rest, ".")
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("empty field path")
+	}
+	return segments, nil
+}
+
+// removeFields removes the fields at path for which remove returns true.
+func removeFields(object interface{}, path []string, remove func(interface{}) bool) {
+	switch o := object.(type) {
+	case map[string]interface{}:
+		for key, value := range o {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			if len(path) == 1 {
+				if remove(value) {
+					delete(o, key)
+				}
+			} else {
+				removeFields(value, path[1:], remove)
+			}
+		}
+	case []interface{}:
+		if path[0] != "*" || len(path) == 1 {
+			return
+		}
+		for _, value := range o {
+			removeFields(value, path[1:], remove)
+		}
+	}
+}
+
+// copyFields copies the fields of src at path to dst where dst does not set
+// them. List elements are matched by index, and only in lists of equal length.
+func copyFields(dst interface{}, src interface{}, path []string) {
+	switch d := dst.(type) {
+	case map[string]interface{}:
+		s, ok := src.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, value := range s {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			if len(path) == 1 {
+				if _, ok := d[key]; !ok {
+					d[key] = runtime.DeepCopyJSONValue(value)
+				}
+			} else if next, ok := d[key]; ok {
+				copyFields(next, value, path[1:])
+			}
+		}
+	case []interface{}:
+		s, ok := src.([]interface{})
+		if !ok || path[0] != "*" || len(path) == 1 || len(s) != len(d) {
+			return
+		}
+		for i := range d {
+			copyFields(d[i], s[i], path[1:])
+		}
+	}
+}
+
+// fieldSet reports whether a field at path holds a non-empty value.
+func fieldSet(object interface{}, path []string) bool {
+	if len(path) == 0 {
+		v := reflect.ValueOf(object)
+		switch v.Kind() {
+		case reflect.Invalid:
+			return false
+		case reflect.Map, reflect.Slice, reflect.String:
+			return v.Len() > 0
+		}
+		return true
+	}
+	switch o := object.(type) {
+	case map[string]interface{}:
+		for key, value := range o {
+			if (path[0] == "*" || path[0] == key) && fieldSet(value, path[1:]) {
+				return true
+			}
+		}
+	case []interface{}:
+		if path[0] != "*" {
+			return false
+		}
+		for _, value := range o {
+			if fieldSet(value, path[1:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fieldStrings returns the strings at path.
+func fieldStrings(object interface{}, path []string) []string {
+	if len(path) == 0 {
+		if s, ok := object.(string); ok {
+			return []string{s}
+		}
+		return nil
+	}
+	var values []string
+	switch o := object.(type) {
+	case map[string]interface{}:
+		for key, value := range o {
+			if path[0] == "*" || path[0] == key {
+				values = append(values, fieldStrings(value, path[1:])...)
+			}
+		}
+	case []interface{}:
+		if path[0] != "*" {
+			return nil
+		}
+		for _, value := range o {
+			values = append(values, fieldStrings(value, path[1:])...)
+		}
+	}
+	return values
+}
+
+// jsonEqual compares values as their JSON encoding, so that e.g. numbers read
+// from YAML and from the API server compare equal.
+func jsonEqual(a interface{}, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
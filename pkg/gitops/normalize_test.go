@@ -0,0 +1,200 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	crdv1alpha1 "antrea.io/antrea/pkg/apis/crd/v1alpha1"
+	"github.com/ghodss/yaml"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestLoadNormalizationConfig(t *testing.T) {
+	c, err := LoadNormalizationConfig("../../reference-manifests/normalization.yaml")
+	assert.NoError(t, err, "unable to load reference normalization config")
+	assert.Equal(t, DefaultNormalizationConfig(), c, "reference manifest should match the built-in defaults")
+
+	tmpDir, err := ioutil.TempDir("", "normalization")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	invalid := []string{
+		"rules:\n- drop: [.metadata..uid]\n",
+		"rules:\n- drop: [\".metadata.annotations['foo\"]\n",
+		"rules:\n- defaults:\n  - path: .spec.policyTypes\n",
+		"rules:\n- defaults:\n  - {path: .spec.policyTypes, value: [Ingress], when: ['']}\n",
+	}
+	for i, content := range invalid {
+		path := filepath.Join(tmpDir, "normalization.yaml")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		_, err = LoadNormalizationConfig(path)
+		assert.Error(t, err, "invalid normalization config %d should have been rejected", i)
+	}
+}
+
+func TestParseFieldPath(t *testing.T) {
+	path, err := parseFieldPath(".spec.ingress[*].ports")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"spec", "ingress", "*", "ports"}, path)
+	path, err = parseFieldPath("metadata.annotations['example.com/key']")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"metadata", "annotations", "example.com/key"}, path)
+}
+
+func TestNormalizeResource(t *testing.T) {
+	defer SetNormalizationConfig(DefaultNormalizationConfig())
+	normalize := func(y string) string {
+		resource := &unstructured.Unstructured{}
+		assert.NoError(t, yaml.Unmarshal([]byte(y), &resource.Object))
+		normalizeResource(resource)
+		normalized, err := yaml.Marshal(resource)
+		assert.NoError(t, err)
+		return string(normalized)
+	}
+
+	// Server-managed fields and defaulted policy types are removed
+	assert.Equal(t, `apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: npA
+  namespace: nsA
+spec:
+  ingress:
+  - {}
+  podSelector: {}
+`, normalize(`apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: npA
+  namespace: nsA
+  uid: uidA
+  resourceVersion: "42"
+  generation: 2
+  creationTimestamp: "2021-06-10T20:48:02Z"
+  annotations:
+    kubectl.kubernetes.io/last-applied-configuration: "{}"
+spec:
+  ingress:
+  - {}
+  podSelector: {}
+  policyTypes:
+  - Ingress
+`))
+	// Policy types that differ from the default are kept
+	egressOnly := `apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: npB
+  namespace: nsA
+spec:
+  egress:
+  - {}
+  podSelector: {}
+  policyTypes:
+  - Egress
+`
+	assert.Equal(t, egressOnly, normalize(egressOnly))
+	denyEgress := `apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: npC
+  namespace: nsA
+spec:
+  podSelector: {}
+  policyTypes:
+  - Ingress
+  - Egress
+`
+	assert.Equal(t, denyEgress, normalize(denyEgress))
+
+	SetNormalizationConfig(&NormalizationConfig{Rules: []NormalizationRule{
+		{Drop: []string{".spec.ingress[*].ports[*].endPort"}},
+		{Group: "crd.antrea.io", Kind: "Tier", Drop: []string{".spec.description"}},
+		{
+			Labels:      &KeyFilter{Allow: []string{"app", "team.example.com/*"}},
+			Annotations: &KeyFilter{Deny: []string{"example.com/*"}},
+		},
+	}})
+	assert.Equal(t, `apiVersion: crd.antrea.io/v1alpha1
+kind: ClusterNetworkPolicy
+metadata:
+  labels:
+    app: web
+    team.example.com/owner: alice
+  name: cnpA
+spec:
+  description: kept
+  ingress:
+  - ports:
+    - port: 80
+`, normalize(`apiVersion: crd.antrea.io/v1alpha1
+kind: ClusterNetworkPolicy
+metadata:
+  annotations:
+    example.com/note: dropped
+  labels:
+    app: web
+    pod-template-hash: abc
+    team.example.com/owner: alice
+  name: cnpA
+spec:
+  description: kept
+  ingress:
+  - ports:
+    - endPort: 90
+      port: 80
+`))
+}
+
+func TestRollbackRestoresNormalizedFields(t *testing.T) {
+	defer SetNormalizationConfig(DefaultNormalizationConfig())
+	SetNormalizationConfig(&NormalizationConfig{Rules: append(DefaultNormalizationConfig().Rules,
+		NormalizationRule{Group: "crd.antrea.io", Kind: "Tier", Drop: []string{".spec.description"}},
+		NormalizationRule{Labels: &KeyFilter{Allow: []string{"app"}}},
+	)})
+	tier := Tier1.inputResource.(*crdv1alpha1.Tier).DeepCopy()
+	tier.ResourceVersion = ""
+	tier.SetLabels(map[string]string{"app": "web", "owner": "alice"})
+	fakeClient := NewClient(tier)
+	k8s := &K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	target, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get target commit")
+
+	live := &crdv1alpha1.Tier{}
+	assert.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(tier), live))
+	live.Spec.Priority = 20
+	assert.NoError(t, fakeClient.Update(context.TODO(), live))
+	assert.NoError(t, cr.Reconcile(), "unable to record tier update")
+
+	// Fields the repository does not hold are kept from the live object
+	_, err = cr.RollbackRepo(target, RollbackOptions{})
+	assert.NoError(t, err, "unable to roll back")
+	assert.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(tier), live))
+	assert.Equal(t, int32(10), live.Spec.Priority)
+	assert.Equal(t, "This is a test tier", live.Spec.Description, "dropped field cleared by rollback")
+	assert.Equal(t, map[string]string{"app": "web", "owner": "alice"}, live.GetLabels(), "filtered label cleared by rollback")
+}
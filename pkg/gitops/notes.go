@@ -0,0 +1,137 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// notesRef is the default ref of git notes, shown by git log.
+const notesRef = plumbing.ReferenceName("refs/notes/commits")
+
+// addNote attaches text to a commit as a git note, replacing any previous note
+// of that commit. Notes are stored without fan-out, one blob per annotated
+// commit named by its hash, in the tree of a commit on notesRef.
+func (cr *CustomRepo) addNote(commit plumbing.Hash, text string) error {
+	var parents []plumbing.Hash
+	entries := map[string]object.TreeEntry{}
+	ref, err := cr.Repo.Reference(notesRef, true)
+	if err == nil {
+		notesCommit, err := cr.Repo.CommitObject(ref.Hash())
+		if err != nil {
+			return fmt.Errorf("unable to get notes commit: %w", err)
+		}
+		tree, err := notesCommit.Tree()
+		if err != nil {
+			return fmt.Errorf("unable to get notes tree: %w", err)
+		}
+		for _, entry := range tree.Entries {
+			entries[entry.Name] = entry
+		}
+		parents = append(parents, ref.Hash())
+	} else if err != plumbing.ErrReferenceNotFound {
+		return fmt.Errorf("unable to get notes ref: %w", err)
+	}
+
+	blob := cr.Repo.Storer.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	w, err := blob.Writer()
+	if err != nil {
+		return fmt.Errorf("unable to write note: %w", err)
+	}
+	if _, err := w.Write([]byte(text)); err != nil {
+		w.Close()
+		return fmt.Errorf("unable to write note: %w", err)
+	}
+	w.Close()
+	blobHash, err := cr.Repo.Storer.SetEncodedObject(blob)
+	if err != nil {
+		return fmt.Errorf("unable to store note: %w", err)
+	}
+	entries[commit.String()] = object.TreeEntry{Name: commit.String(), Mode: filemode.Regular, Hash: blobHash}
+
+	tree := &object.Tree{}
+	for _, entry := range entries {
+		tree.Entries = append(tree.Entries, entry)
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool {
+		return tree.Entries[i].Name < tree.Entries[j].Name
+	})
+	treeHash, err := cr.storeObject(tree)
+	if err != nil {
+		return fmt.Errorf("unable to store notes tree: %w", err)
+	}
+	signature := object.Signature{Name: "audit-correlator", Email: "system@audit.antrea.io", When: time.Now()}
+	notesCommit := &object.Commit{
+		Author:       signature,
+		Committer:    signature,
+		Message:      "Notes added by audit-correlator",
+		TreeHash:     treeHash,
+		ParentHashes: parents,
+	}
+	notesCommitHash, err := cr.storeObject(notesCommit)
+	if err != nil {
+		return fmt.Errorf("unable to store notes commit: %w", err)
+	}
+	if err := cr.Repo.Storer.SetReference(plumbing.NewHashReference(notesRef, notesCommitHash)); err != nil {
+		return fmt.Errorf("unable to update notes ref: %w", err)
+	}
+	return nil
+}
+
+// readNotes returns the git notes of every annotated commit.
+func (cr *CustomRepo) readNotes() (map[plumbing.Hash]string, error) {
+	notes := map[plumbing.Hash]string{}
+	ref, err := cr.Repo.Reference(notesRef, true)
+	if err == plumbing.ErrReferenceNotFound {
+		return notes, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to get notes ref: %w", err)
+	}
+	notesCommit, err := cr.Repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("unable to get notes commit: %w", err)
+	}
+	tree, err := notesCommit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get notes tree: %w", err)
+	}
+	for _, entry := range tree.Entries {
+		text, err := cr.readBlob(entry.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read note %s: %w", entry.Name, err)
+		}
+		notes[plumbing.NewHash(entry.Name)] = string(text)
+	}
+	return notes, nil
+}
+
+type encodableObject interface {
+	Encode(plumbing.EncodedObject) error
+}
+
+func (cr *CustomRepo) storeObject(o encodableObject) (plumbing.Hash, error) {
+	obj := cr.Repo.Storer.NewEncodedObject()
+	if err := o.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return cr.Repo.Storer.SetEncodedObject(obj)
+}
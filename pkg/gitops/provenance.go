@@ -0,0 +1,191 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"strconv"
+	"strings"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"antrea.io/resource-auditing/pkg/types"
+)
+
+// Git trailers recording the provenance of a change. Keys for multi-valued
+// fields are repeated, once per value.
+const (
+	trailerAuditID          = "Audit-ID"
+	trailerGroup            = "User-Group"
+	trailerImpersonatedUser = "Impersonated-User"
+	trailerSourceIP         = "Source-IP"
+	trailerUserAgent        = "User-Agent"
+	trailerRequestURI       = "Request-URI"
+	trailerResponseCode     = "Response-Code"
+	trailerFieldManager     = "Field-Manager"
+	trailerResourceVersion  = "Resource-Version"
+	trailerUnattributed     = "Unattributed"
+)
+
+// ProvenanceFilter selects commits by provenance. Empty fields match any
+// commit; Group and SourceIP match any of the recorded values, UserAgent
+// matches a substring and RequestURI a prefix.
+type ProvenanceFilter struct {
+	AuditID          string
+	Group            string
+	ImpersonatedUser string
+	SourceIP         string
+	UserAgent        string
+	RequestURI       string
+	ResponseCode     int32
+}
+
+func eventProvenance(event auditv1.Event) types.Provenance {
+	provenance := types.Provenance{
+		AuditID:    string(event.AuditID),
+		Groups:     event.User.Groups,
+		SourceIPs:  event.SourceIPs,
+		UserAgent:  event.UserAgent,
+		RequestURI: event.RequestURI,
+	}
+	if event.ImpersonatedUser != nil {
+		provenance.ImpersonatedUser = event.ImpersonatedUser.Username
+	}
+	if event.ResponseStatus != nil {
+		provenance.ResponseCode = event.ResponseStatus.Code
+	}
+	return provenance
+}
+
+// formatTrailers returns the trailer block to append to a commit message, or
+// an empty string when nothing is known about the request.
+func formatTrailers(provenance types.Provenance) string {
+	var b strings.Builder
+	add := func(key, value string) {
+		if value == "" {
+			return
+		}
+		value = strings.Join(strings.Fields(value), " ")
+		b.WriteString(key + ": " + value + "\n")
+	}
+	add(trailerAuditID, provenance.AuditID)
+	for _, group := range provenance.Groups {
+		add(trailerGroup, group)
+	}
+	add(trailerImpersonatedUser, provenance.ImpersonatedUser)
+	for _, ip := range provenance.SourceIPs {
+		add(trailerSourceIP, ip)
+	}
+	add(trailerUserAgent, provenance.UserAgent)
+	add(trailerRequestURI, provenance.RequestURI)
+	if provenance.ResponseCode != 0 {
+		add(trailerResponseCode, strconv.Itoa(int(provenance.ResponseCode)))
+	}
+	add(trailerFieldManager, provenance.FieldManager)
+	add(trailerResourceVersion, provenance.ResourceVersion)
+	if provenance.Unattributed {
+		add(trailerUnattributed, "true")
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return "\n\n" + strings.TrimSuffix(b.String(), "\n")
+}
+
+// ParseProvenance splits a commit message into its description and the
+// provenance recorded in its trailers. The provenance is nil for commits
+// without trailers, such as commits made by the auditing system itself.
+func ParseProvenance(message string) (string, *types.Provenance) {
+	message = strings.TrimRight(message, "\n")
+	i := strings.LastIndex(message, "\n\n")
+	if i < 0 {
+		return message, nil
+	}
+	provenance := &types.Provenance{}
+	for _, line := range strings.Split(message[i+2:], "\n") {
+		key, value, ok := splitTrailer(line)
+		if !ok {
+			return message, nil
+		}
+		switch key {
+		case trailerAuditID:
+			provenance.AuditID = value
+		case trailerGroup:
+			provenance.Groups = append(provenance.Groups, value)
+		case trailerImpersonatedUser:
+			provenance.ImpersonatedUser = value
+		case trailerSourceIP:
+			provenance.SourceIPs = append(provenance.SourceIPs, value)
+		case trailerUserAgent:
+			provenance.UserAgent = value
+		case trailerRequestURI:
+			provenance.RequestURI = value
+		case trailerResponseCode:
+			code, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return message, nil
+			}
+			provenance.ResponseCode = int32(code)
+		case trailerFieldManager:
+			provenance.FieldManager = value
+		case trailerResourceVersion:
+			provenance.ResourceVersion = value
+		case trailerUnattributed:
+			provenance.Unattributed = value == "true"
+		default:
+			return message, nil
+		}
+	}
+	return message[:i], provenance
+}
+
+func splitTrailer(line string) (string, string, bool) {
+	i := strings.Index(line, ": ")
+	if i < 0 {
+		return "", "", false
+	}
+	return line[:i], line[i+2:], true
+}
+
+func (f ProvenanceFilter) empty() bool {
+	return f == ProvenanceFilter{}
+}
+
+func (f ProvenanceFilter) matches(provenance *types.Provenance) bool {
+	if provenance == nil {
+		return false
+	}
+	if f.AuditID != "" && f.AuditID != provenance.AuditID {
+		return false
+	}
+	if f.Group != "" && !stringInSlice(f.Group, provenance.Groups) {
+		return false
+	}
+	if f.ImpersonatedUser != "" && f.ImpersonatedUser != provenance.ImpersonatedUser {
+		return false
+	}
+	if f.SourceIP != "" && !stringInSlice(f.SourceIP, provenance.SourceIPs) {
+		return false
+	}
+	if f.UserAgent != "" && !strings.Contains(provenance.UserAgent, f.UserAgent) {
+		return false
+	}
+	if f.RequestURI != "" && !strings.HasPrefix(provenance.RequestURI, f.RequestURI) {
+		return false
+	}
+	if f.ResponseCode != 0 && f.ResponseCode != provenance.ResponseCode {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"antrea.io/resource-auditing/pkg/types"
+)
+
+func TestParseProvenance(t *testing.T) {
+	provenance := types.Provenance{
+		AuditID:          "c05e9a10-4668-4a20-886a-bbb9fbad2d73",
+		Groups:           []string{"system:masters", "system:authenticated"},
+		ImpersonatedUser: "alice",
+		SourceIPs:        []string{"192.168.77.1", "10.0.0.1"},
+		UserAgent:        "kubectl/v1.21.1 (darwin/amd64)\nkubernetes/5e58841",
+		RequestURI:       "/apis/networking.k8s.io/v1/namespaces/default/networkpolicies",
+		ResponseCode:     201,
+	}
+	message, parsed := ParseProvenance("Created K8s network policy default/np" + formatTrailers(provenance))
+	assert.Equal(t, "Created K8s network policy default/np", message)
+	provenance.UserAgent = "kubectl/v1.21.1 (darwin/amd64) kubernetes/5e58841"
+	assert.Equal(t, &provenance, parsed)
+
+	message, parsed = ParseProvenance("Rollback to commit abc\n\nScope: resource=k8s-policies")
+	assert.Equal(t, "Rollback to commit abc\n\nScope: resource=k8s-policies", message)
+	assert.Nil(t, parsed, "scope is not a provenance trailer")
+	assert.Equal(t, "", formatTrailers(types.Provenance{}))
+}
+
+func TestFilterCommitsByProvenance(t *testing.T) {
+	k8s := &K8sClient{
+		Client: NewClient(Np1.inputResource, Anp1.inputResource),
+	}
+	jsonStr, err := ioutil.ReadFile("../../test/files/correct-audit-log.txt")
+	assert.NoError(t, err, "could not read mock audit log")
+	cr, err := SetupRepo(k8s, StorageModeInMemory, "")
+	assert.NoError(t, err, "could not set up mock repo")
+	assert.NoError(t, cr.HandleEventList(jsonStr), "could not handle mock eventlist")
+
+	filter := func(provenance ProvenanceFilter) []string {
+		commits, err := cr.FilterCommits("", time.Time{}, time.Time{}, "", "", "", provenance)
+		assert.NoError(t, err, "could not filter commits by provenance")
+		var messages []string
+		for _, c := range commits {
+			message, _ := ParseProvenance(c.Message)
+			messages = append(messages, message)
+		}
+		return messages
+	}
+	assert.Equal(t, []string{"Updated K8s network policy default/allow-client1"},
+		filter(ProvenanceFilter{AuditID: "094e8e21-3f57-46d4-8a51-628f3a74acd4"}))
+	assert.Equal(t, []string{"Created K8s network policy default/allow-client1"},
+		filter(ProvenanceFilter{ResponseCode: 201}))
+	assert.Len(t, filter(ProvenanceFilter{Group: "system:masters", SourceIP: "192.168.77.1", UserAgent: "kubectl/"}), 3)
+	assert.Len(t, filter(ProvenanceFilter{RequestURI: "/apis/crd.antrea.io/"}), 1)
+	assert.Empty(t, filter(ProvenanceFilter{ImpersonatedUser: "alice"}))
+}
@@ -0,0 +1,238 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"k8s.io/klog/v2"
+)
+
+// queueCompactSize is how many acknowledged bytes may remain at the head of a
+// queue file before it is rewritten without them.
+var queueCompactSize int64 = 1 << 20
+
+// eventQueue is a durable, append-only log of raw audit EventLists. Each record
+// is a 4-byte big-endian length followed by the payload. The offset of the
+// first record not yet processed is stored in a separate file, and both files
+// are removed once every record has been acknowledged. As records may keep
+// being appended while others are processed, the file is also compacted once
+// its acknowledged head exceeds queueCompactSize.
+//
+// The dead-letter queue is only ever appended to, and must be trimmed by hand
+// once its records have been inspected.
+type eventQueue struct {
+	mutex sync.Mutex
+	fs    billy.Filesystem
+	name  string
+	// base is the number of bytes removed from the head of the file since the
+	// queue was opened, so that the offsets returned by records stay valid
+	// after a compaction.
+	base int64
+}
+
+type queueRecord struct {
+	data []byte
+	// next is the offset of the following record, to be passed to ack.
+	next int64
+}
+
+func newEventQueue(fs billy.Filesystem, name string) *eventQueue {
+	return &eventQueue{fs: fs, name: name}
+}
+
+func (q *eventQueue) offsetName() string {
+	return q.name + ".offset"
+}
+
+// append durably adds a record to the end of the queue.
+func (q *eventQueue) append(data []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	f, err := q.fs.OpenFile(q.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open queue %s: %w", q.name, err)
+	}
+	defer f.Close()
+	record := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[4:], data)
+	if _, err := f.Write(record); err != nil {
+		return fmt.Errorf("unable to append to queue %s: %w", q.name, err)
+	}
+	return syncFile(f)
+}
+
+// records returns every record after the last acknowledged offset. A record
+// cut short by a crash during append is dropped from the end of the queue.
+func (q *eventQueue) records() ([]queueRecord, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	offset, err := q.ackedOffset()
+	if err != nil {
+		return nil, err
+	}
+	f, err := q.fs.OpenFile(q.name, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to open queue %s: %w", q.name, err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("unable to seek queue %s: %w", q.name, err)
+	}
+	var records []queueRecord
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(f, header); err == io.EOF {
+			break
+		} else if err != nil {
+			return records, q.truncate(f, offset)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(f, data); err != nil {
+			return records, q.truncate(f, offset)
+		}
+		offset += int64(4 + len(data))
+		records = append(records, queueRecord{data: data, next: q.base + offset})
+	}
+	return records, nil
+}
+
+func (q *eventQueue) truncate(f billy.File, offset int64) error {
+	klog.InfoS("dropping incomplete record at end of queue", "queue", q.name, "offset", offset)
+	if err := f.Truncate(offset); err != nil {
+		return fmt.Errorf("unable to truncate queue %s: %w", q.name, err)
+	}
+	return syncFile(f)
+}
+
+// ack records that every record before offset next has been processed.
+func (q *eventQueue) ack(next int64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	next -= q.base
+	if next <= 0 {
+		return nil
+	}
+	info, err := q.fs.Stat(q.name)
+	if err != nil {
+		return fmt.Errorf("unable to stat queue %s: %w", q.name, err)
+	}
+	if next >= info.Size() {
+		if err := q.reset(); err != nil {
+			return err
+		}
+		q.base += info.Size()
+		return nil
+	}
+	if next > queueCompactSize {
+		return q.compact(next)
+	}
+	return q.writeOffset(next)
+}
+
+// compact rewrites the queue file without the records before offset next. The
+// offset is reset before the new file replaces the old one: a crash in between
+// replays acknowledged records, which are then skipped by their audit ID,
+// rather than skipping records that were never processed.
+func (q *eventQueue) compact(next int64) error {
+	src, err := q.fs.Open(q.name)
+	if err != nil {
+		return fmt.Errorf("unable to compact queue %s: %w", q.name, err)
+	}
+	defer src.Close()
+	if _, err := src.Seek(next, io.SeekStart); err != nil {
+		return fmt.Errorf("unable to compact queue %s: %w", q.name, err)
+	}
+	tmpName := q.name + ".tmp"
+	f, err := q.fs.Create(tmpName)
+	if err != nil {
+		return fmt.Errorf("unable to compact queue %s: %w", q.name, err)
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to compact queue %s: %w", q.name, err)
+	}
+	if err := syncFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := q.writeOffset(0); err != nil {
+		return err
+	}
+	if err := q.fs.Rename(tmpName, q.name); err != nil {
+		return fmt.Errorf("unable to compact queue %s: %w", q.name, err)
+	}
+	q.base += next
+	return nil
+}
+
+func (q *eventQueue) writeOffset(next int64) error {
+	f, err := q.fs.Create(q.offsetName())
+	if err != nil {
+		return fmt.Errorf("unable to write offset of queue %s: %w", q.name, err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(strconv.FormatInt(next, 10))); err != nil {
+		return fmt.Errorf("unable to write offset of queue %s: %w", q.name, err)
+	}
+	return syncFile(f)
+}
+
+// reset discards every record in the queue.
+func (q *eventQueue) reset() error {
+	for _, name := range []string{q.offsetName(), q.name} {
+		if err := q.fs.Remove(name); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (q *eventQueue) ackedOffset() (int64, error) {
+	b, err := util.ReadFile(q.fs, q.offsetName())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("unable to read offset of queue %s: %w", q.name, err)
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset for queue %s: %w", q.name, err)
+	}
+	return offset, nil
+}
+
+// syncFile flushes f to stable storage when the filesystem supports it; the
+// in-memory filesystem used by tests does not.
+func syncFile(f billy.File) error {
+	if s, ok := f.(interface{ Sync() error }); ok {
+		if err := s.Sync(); err != nil {
+			return fmt.Errorf("unable to sync %s: %w", f.Name(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventQueue(t *testing.T) {
+	fs := osfs.New(t.TempDir())
+	q := newEventQueue(fs, "queue")
+	records, err := q.records()
+	assert.NoError(t, err, "unable to read empty queue")
+	assert.Empty(t, records)
+
+	for _, data := range []string{"first", "second", "third"} {
+		assert.NoError(t, q.append([]byte(data)), "unable to append to queue")
+	}
+	records, err = q.records()
+	assert.NoError(t, err, "unable to read queue")
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, "first", string(records[0].data))
+
+	// Acknowledged records are not returned again, even after reopening
+	assert.NoError(t, q.ack(records[0].next), "unable to ack record")
+	q = newEventQueue(fs, "queue")
+	records, err = q.records()
+	assert.NoError(t, err, "unable to read queue")
+	assert.Equal(t, []string{"second", "third"}, []string{string(records[0].data), string(records[1].data)})
+
+	// A partially written record is dropped
+	f, err := fs.OpenFile("queue", os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err, "unable to open queue file")
+	_, err = f.Write([]byte{0, 0, 0, 10, 'x'})
+	assert.NoError(t, err, "unable to write partial record")
+	f.Close()
+	records, err = q.records()
+	assert.NoError(t, err, "unable to read queue with partial record")
+	assert.Equal(t, 2, len(records))
+	assert.NoError(t, q.append([]byte("fourth")), "unable to append to queue")
+	records, err = q.records()
+	assert.NoError(t, err, "unable to read queue")
+	assert.Equal(t, "fourth", string(records[2].data))
+
+	// Acknowledging everything removes the queue
+	assert.NoError(t, q.ack(records[2].next), "unable to ack records")
+	_, err = fs.Stat("queue")
+	assert.True(t, os.IsNotExist(err), "drained queue not removed")
+	_, err = fs.Stat("queue.offset")
+	assert.True(t, os.IsNotExist(err), "drained queue offset not removed")
+}
+
+func TestEventQueueCompaction(t *testing.T) {
+	defer func(size int64) { queueCompactSize = size }(queueCompactSize)
+	queueCompactSize = 10
+	fs := osfs.New(t.TempDir())
+	q := newEventQueue(fs, "queue")
+	for _, data := range []string{"first", "second", "third"} {
+		assert.NoError(t, q.append([]byte(data)), "unable to append to queue")
+	}
+	records, err := q.records()
+	assert.NoError(t, err, "unable to read queue")
+	assert.Equal(t, 3, len(records))
+
+	// A list appended while the others are handled keeps the queue from
+	// draining, so the acknowledged head is compacted away instead
+	assert.NoError(t, q.append([]byte("fourth")), "unable to append to queue")
+	before, err := fs.Stat("queue")
+	assert.NoError(t, err, "unable to stat queue")
+	for _, record := range records {
+		assert.NoError(t, q.ack(record.next), "unable to ack record")
+	}
+	after, err := fs.Stat("queue")
+	assert.NoError(t, err, "unable to stat queue")
+	assert.Less(t, after.Size(), before.Size(), "queue not compacted")
+
+	q = newEventQueue(fs, "queue")
+	records, err = q.records()
+	assert.NoError(t, err, "unable to read compacted queue")
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, "fourth", string(records[0].data))
+	assert.NoError(t, q.ack(records[0].next), "unable to ack record")
+	_, err = fs.Stat("queue")
+	assert.True(t, os.IsNotExist(err), "drained queue not removed")
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// RunReconciler periodically reconciles the repository with the live cluster
+// state until stopCh is closed. A non-positive interval disables it. The first
+// reconciliation runs one interval after the start, as SetupRepo reconciles an
+// existing repository already.
+func (cr *CustomRepo) RunReconciler(interval time.Duration, stopCh <-chan struct{}) {
+	if interval <= 0 {
+		klog.V(2).InfoS("periodic drift reconciliation disabled")
+		return
+	}
+	select {
+	case <-stopCh:
+		return
+	case <-time.After(interval):
+	}
+	wait.Until(func() {
+		if err := cr.Reconcile(); err != nil {
+			klog.ErrorS(err, "drift reconciliation failed")
+		}
+	}, interval, stopCh)
+}
+
+func (cr *CustomRepo) Reconcile() error {
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	if cr.RollbackMode {
+		klog.V(2).InfoS("rollback in progress - skipping drift reconciliation")
+		return nil
+	}
+	return cr.reconcile()
+}
+
+// reconcile compares every audited resource in the cluster with the worktree
+// and records any difference in a single "Drift reconciliation" commit.
+func (cr *CustomRepo) reconcile() error {
+	var added, changed, removed []string
+	for _, resourceType := range registry.Types {
+		files, err := cr.getResourceFiles(resourceType)
+		if errors.Is(err, errResourceTypeNotServed) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("unable to get cluster resources for type %s: %w", resourceType.GroupVersionKind().String(), err)
+		}
+		existing, err := cr.listFiles(computePath("", resourceType.Dir, "", ""))
+		if err != nil {
+			return fmt.Errorf("unable to get repository resources for type %s: %w", resourceType.GroupVersionKind().String(), err)
+		}
+		for _, path := range existing {
+			y, ok := files[path]
+			if !ok {
+				if err := cr.removePath(path); err != nil {
+					return fmt.Errorf("unable to remove stale resource: %w", err)
+				}
+				removed = append(removed, path)
+				continue
+			}
+			old, err := util.ReadFile(cr.Fs, path)
+			if err != nil {
+				return fmt.Errorf("unable to read file at %s: %w", path, err)
+			}
+			if !bytes.Equal(old, y) {
+				if err := cr.writeFileToPath(path, y); err != nil {
+					return fmt.Errorf("could not write yaml to path %s: %w", path, err)
+				}
+				changed = append(changed, path)
+			}
+			delete(files, path)
+		}
+		for path, y := range files {
+			if err := cr.writeFileToPath(path, y); err != nil {
+				return fmt.Errorf("could not write yaml to path %s: %w", path, err)
+			}
+			added = append(added, path)
+		}
+	}
+	if len(added)+len(changed)+len(removed) == 0 {
+		klog.V(2).InfoS("repository in sync with cluster, no drift found")
+		return nil
+	}
+	message := "Drift reconciliation\n" +
+		formatPathList("Added", added) +
+		formatPathList("Changed", changed) +
+		formatPathList("Removed", removed)
+	if err := cr.AddAndCommit("audit-reconciler", "system@audit.antrea.io", message); err != nil {
+		return fmt.Errorf("unable to add/commit drift reconciliation: %w", err)
+	}
+	klog.V(2).InfoS("drift reconciliation committed", "added", len(added), "changed", len(changed), "removed", len(removed))
+	return nil
+}
+
+func formatPathList(title string, paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	sort.Strings(paths)
+	return "\n" + title + ":\n  " + strings.Join(paths, "\n  ") + "\n"
+}
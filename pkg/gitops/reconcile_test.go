@@ -0,0 +1,108 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+	networkingv1 "k8s.io/api/networking/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestReconcile(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+
+	// Nothing changed, so no commit should be created
+	err = cr.Reconcile()
+	assert.NoError(t, err, "reconcile failed")
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, h.Hash(), newH.Hash(), "reconcile without drift should not commit")
+
+	// Drift the cluster away from the repository
+	assert.NoError(t, fakeClient.Create(context.TODO(), np2.DeepCopy()))
+	updatedNP := &networkingv1.NetworkPolicy{}
+	assert.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(np1), updatedNP))
+	updatedNP.SetLabels(map[string]string{"drift": "true"})
+	assert.NoError(t, fakeClient.Update(context.TODO(), updatedNP))
+	assert.NoError(t, fakeClient.Delete(context.TODO(), anp1.DeepCopy()))
+
+	err = cr.Reconcile()
+	assert.NoError(t, err, "reconcile failed")
+	newH, err = cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(newH.Hash())
+	assert.NoError(t, err, "unable to get reconcile commit object")
+	assert.Equal(t, `Drift reconciliation
+
+Added:
+  k8s-policies/nsA/npB.yaml
+
+Changed:
+  k8s-policies/nsA/npA.yaml
+
+Removed:
+  antrea-policies/nsA/anpA.yaml
+`, commit.Message, "unexpected drift reconciliation commit message")
+
+	y, err := util.ReadFile(cr.Fs, "k8s-policies/nsA/npA.yaml")
+	assert.NoError(t, err, "unable to read changed resource")
+	assert.Contains(t, string(y), "drift: \"true\"", "changed resource not updated in repo")
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npB.yaml")
+	assert.NoError(t, err, "added resource missing from repo")
+	_, err = cr.Fs.Stat("antrea-policies/nsA/anpA.yaml")
+	assert.True(t, os.IsNotExist(err), "removed resource still in repo")
+}
+
+func TestRunReconcilerFirstDelay(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.NoError(t, fakeClient.Create(context.TODO(), np2.DeepCopy()))
+
+	head := func() plumbing.Hash {
+		cr.Mutex.Lock()
+		defer cr.Mutex.Unlock()
+		ref, err := cr.Repo.Head()
+		assert.NoError(t, err, "unable to get repo head ref")
+		return ref.Hash()
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go cr.RunReconciler(300*time.Millisecond, stopCh)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, h.Hash(), head(), "reconciled right after start")
+	assert.Eventually(t, func() bool {
+		return head() != h.Hash()
+	}, 5*time.Second, 20*time.Millisecond, "drift not reconciled after one interval")
+}
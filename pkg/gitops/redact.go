@@ -0,0 +1,255 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// RedactionConfig lists the values replaced with a hash before objects are
+// written to the repository. The hash is keyed with Salt, so that short values
+// cannot be recovered by hashing candidates.
+type RedactionConfig struct {
+	Salt  string          `json:"salt,omitempty"`
+	Rules []RedactionRule `json:"rules"`
+}
+
+// RedactionRule applies to objects of the given Group and Kind, or to all
+// objects when both are empty. The values of the Labels and Annotations keys,
+// exact or prefixes ending with *, and the strings under the Fields paths are
+// redacted. Matches of the Patterns regular expressions are redacted within
+// all other label and annotation values.
+type RedactionRule struct {
+	Group       string   `json:"group,omitempty"`
+	Kind        string   `json:"kind,omitempty"`
+	Labels      []string `json:"labels,omitempty"`
+	Annotations []string `json:"annotations,omitempty"`
+	Fields      []string `json:"fields,omitempty"`
+	Patterns    []string `json:"patterns,omitempty"`
+}
+
+const redactedPrefix = "redacted-"
+
+var redactedValuePattern = regexp.MustCompile(redactedPrefix + "[0-9a-f]{16}")
+
+var redaction = &RedactionConfig{}
+
+// LoadRedactionConfig reads a YAML or JSON file with a salt and a top-level
+// rules list. Nothing is redacted unless a config is set.
+func LoadRedactionConfig(path string) (*RedactionConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read redaction config file: %w", err)
+	}
+	c := &RedactionConfig{}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal redaction config: %w", err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid redaction config %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// SetRedactionConfig replaces the redaction used by the package. It must be
+// called before the repository is set up.
+func SetRedactionConfig(c *RedactionConfig) {
+	redaction = c
+}
+
+func (c *RedactionConfig) validate() error {
+	if len(c.Rules) > 0 && c.Salt == "" {
+		return fmt.Errorf("salt is required when redaction rules are configured")
+	}
+	for _, rule := range c.Rules {
+		for _, p := range rule.Fields {
+			if _, err := parseFieldPath(p); err != nil {
+				return err
+			}
+		}
+		for _, p := range rule.Patterns {
+			if _, err := regexp.Compile(p); err != nil {
+				return fmt.Errorf("invalid pattern %s: %w", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// redactedValue returns the stable hash replacing a value, so that diffs show
+// when a redacted value changes.
+func redactedValue(value string) string {
+	mac := hmac.New(sha256.New, []byte(redaction.Salt))
+	mac.Write([]byte(value))
+	return redactedPrefix + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// redactResource replaces the values selected by the redaction rules with their
+// hash.
+func redactResource(resource *unstructured.Unstructured) {
+	gvk := resource.GroupVersionKind()
+	for _, rule := range redaction.Rules {
+		if (rule.Group != "" || rule.Kind != "") && (rule.Group != gvk.Group || rule.Kind != gvk.Kind) {
+			continue
+		}
+		var patterns []*regexp.Regexp
+		for _, p := range rule.Patterns {
+			if re, err := regexp.Compile(p); err == nil {
+				patterns = append(patterns, re)
+			}
+		}
+		if labels := resource.GetLabels(); len(labels) > 0 {
+			resource.SetLabels(redactValues(labels, rule.Labels, patterns))
+		}
+		if annotations := resource.GetAnnotations(); len(annotations) > 0 {
+			resource.SetAnnotations(redactValues(annotations, rule.Annotations, patterns))
+		}
+		for _, p := range rule.Fields {
+			path, _ := parseFieldPath(p)
+			redactFields(resource.Object, path)
+		}
+	}
+}
+
+func redactValues(m map[string]string, keys []string, patterns []*regexp.Regexp) map[string]string {
+	for k, v := range m {
+		if matchesKey(keys, k) {
+			m[k] = redactedValue(v)
+			continue
+		}
+		for _, re := range patterns {
+			v = re.ReplaceAllStringFunc(v, redactedValue)
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// redactFields redacts every string at or under path.
+func redactFields(object interface{}, path []string) {
+	switch o := object.(type) {
+	case map[string]interface{}:
+		for key, value := range o {
+			if len(path) > 0 && path[0] != "*" && path[0] != key {
+				continue
+			}
+			if s, ok := value.(string); ok && len(path) <= 1 {
+				o[key] = redactedValue(s)
+			} else if len(path) == 0 {
+				redactFields(value, nil)
+			} else {
+				redactFields(value, path[1:])
+			}
+		}
+	case []interface{}:
+		if len(path) > 0 && path[0] != "*" {
+			return
+		}
+		for i, value := range o {
+			if s, ok := value.(string); ok && len(path) <= 1 {
+				o[i] = redactedValue(s)
+			} else if len(path) == 0 {
+				redactFields(value, nil)
+			} else {
+				redactFields(value, path[1:])
+			}
+		}
+	}
+}
+
+// restoreRedactedValues replaces the redacted values of a resource read from the
+// repository with the live values they were computed from, so that rollbacks
+// do not write hashes to the cluster. It fails when a redacted value no longer
+// matches the cluster, as the original value cannot be recovered.
+func (cr *CustomRepo) restoreRedactedValues(resource *unstructured.Unstructured) error {
+	if !containsRedactedValue(resource.Object) {
+		return nil
+	}
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(resource.GroupVersionKind())
+	live, err := cr.K8s.GetResource(live, resource.GetNamespace(), resource.GetName())
+	if errors.IsNotFound(err) {
+		return fmt.Errorf("resource %s has redacted values and no longer exists in the cluster", resource.GetName())
+	} else if err != nil {
+		return fmt.Errorf("unable to get live state of resource %s: %w", resource.GetName(), err)
+	}
+	redactedLive := live.DeepCopy()
+	redactResource(redactedLive)
+	resource.Object = restoreValues(resource.Object, redactedLive.Object, live.Object).(map[string]interface{})
+	if containsRedactedValue(resource.Object) {
+		return fmt.Errorf("resource %s has redacted values that differ from the cluster", resource.GetName())
+	}
+	return nil
+}
+
+// restoreValues walks a repository object alongside the redacted and original
+// versions of the live object, replacing the repository strings equal to the
+// redacted version with the original.
+func restoreValues(object interface{}, redacted interface{}, original interface{}) interface{} {
+	switch o := object.(type) {
+	case map[string]interface{}:
+		r, ok1 := redacted.(map[string]interface{})
+		p, ok2 := original.(map[string]interface{})
+		if !ok1 || !ok2 {
+			return object
+		}
+		for key, value := range o {
+			o[key] = restoreValues(value, r[key], p[key])
+		}
+	case []interface{}:
+		r, ok1 := redacted.([]interface{})
+		p, ok2 := original.([]interface{})
+		if !ok1 || !ok2 || len(r) != len(o) || len(p) != len(o) {
+			return object
+		}
+		for i, value := range o {
+			o[i] = restoreValues(value, r[i], p[i])
+		}
+	case string:
+		if r, ok := redacted.(string); ok && r == o && redactedValuePattern.MatchString(o) {
+			return original
+		}
+	}
+	return object
+}
+
+func containsRedactedValue(object interface{}) bool {
+	switch o := object.(type) {
+	case map[string]interface{}:
+		for _, value := range o {
+			if containsRedactedValue(value) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, value := range o {
+			if containsRedactedValue(value) {
+				return true
+			}
+		}
+	case string:
+		return redactedValuePattern.MatchString(o)
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/assert"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var testRedactionConfig = &RedactionConfig{
+	Salt: "test-salt",
+	Rules: []RedactionRule{
+		{
+			Labels:      []string{"owner"},
+			Annotations: []string{"example.com/ticket", "secrets.example.com/*"},
+			Patterns:    []string{`https?://[^\s"]+`},
+		},
+		{Group: "crd.antrea.io", Kind: "Tier", Fields: []string{".spec.description"}},
+	},
+}
+
+func TestLoadRedactionConfig(t *testing.T) {
+	_, err := LoadRedactionConfig("../../reference-manifests/redaction.yaml")
+	assert.NoError(t, err, "unable to load reference redaction config")
+
+	tmpDir, err := ioutil.TempDir("", "redaction")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	invalid := []string{
+		"salt: s\nrules:\n- patterns: ['(unterminated']\n",
+		"salt: s\nrules:\n- fields: [.spec..description]\n",
+		"rules:\n- labels: [owner]\n",
+	}
+	for i, content := range invalid {
+		path := filepath.Join(tmpDir, "redaction.yaml")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		_, err = LoadRedactionConfig(path)
+		assert.Error(t, err, "invalid redaction config %d should have been rejected", i)
+	}
+}
+
+func TestRedactResource(t *testing.T) {
+	SetRedactionConfig(testRedactionConfig)
+	defer SetRedactionConfig(&RedactionConfig{})
+
+	resource := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "crd.antrea.io/v1alpha1",
+		"kind":       "Tier",
+		"metadata": map[string]interface{}{
+			"name":   "TierA",
+			"labels": map[string]interface{}{"owner": "alice", "app": "web"},
+			"annotations": map[string]interface{}{
+				"example.com/ticket":      "ABC-123",
+				"secrets.example.com/key": "hunter2",
+				"note":                    "see https://wiki.internal/page for details",
+			},
+		},
+		"spec": map[string]interface{}{"priority": int64(10), "description": "internal tier"},
+	}}
+	redactResource(resource)
+
+	assert.Equal(t, redactedValue("alice"), resource.GetLabels()["owner"])
+	assert.Equal(t, "web", resource.GetLabels()["app"], "unselected label redacted")
+	annotations := resource.GetAnnotations()
+	assert.Equal(t, redactedValue("ABC-123"), annotations["example.com/ticket"])
+	assert.Equal(t, redactedValue("hunter2"), annotations["secrets.example.com/key"])
+	assert.Equal(t, "see "+redactedValue("https://wiki.internal/page")+" for details", annotations["note"])
+	description, _, _ := unstructured.NestedString(resource.Object, "spec", "description")
+	assert.Equal(t, redactedValue("internal tier"), description)
+	assert.Regexp(t, "^redacted-[0-9a-f]{16}$", description)
+
+	assert.Equal(t, redactedValue("alice"), redactedValue("alice"), "redacted value is not stable")
+	assert.NotEqual(t, redactedValue("alice"), redactedValue("bob"), "different values redacted the same")
+}
+
+func TestRedactionRoundTrip(t *testing.T) {
+	SetRedactionConfig(testRedactionConfig)
+	defer SetRedactionConfig(&RedactionConfig{})
+
+	np := np1.DeepCopy()
+	np.SetAnnotations(map[string]string{"example.com/ticket": "ABC-123"})
+	fakeClient := NewClient(np)
+	k8s := &K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+	y, err := util.ReadFile(cr.Fs, "k8s-policies/nsA/npA.yaml")
+	assert.NoError(t, err, "unable to read policy")
+	assert.NotContains(t, string(y), "ABC-123", "sensitive value written to repository")
+	assert.Contains(t, string(y), redactedValue("ABC-123"))
+
+	// The live value is restored when the cluster still holds it
+	resource, err := cr.getResourceByPath("k8s-policies/nsA/npA.yaml")
+	assert.NoError(t, err, "unable to read policy")
+	assert.NoError(t, cr.restoreRedactedValues(resource))
+	assert.Equal(t, "ABC-123", resource.GetAnnotations()["example.com/ticket"])
+
+	// ...and cannot be once it changed
+	live := &networkingv1.NetworkPolicy{}
+	assert.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(np1), live))
+	live.SetAnnotations(map[string]string{"example.com/ticket": "ABC-456"})
+	assert.NoError(t, fakeClient.Update(context.TODO(), live))
+	resource, err = cr.getResourceByPath("k8s-policies/nsA/npA.yaml")
+	assert.NoError(t, err, "unable to read policy")
+	assert.Error(t, cr.restoreRedactedValues(resource), "redacted value restored from a different live value")
+}
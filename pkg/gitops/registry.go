@@ -0,0 +1,255 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ResourceType describes a kind of resource tracked in the repository. Version
+// is the version resources are listed with; ServedVersions lists any other
+// versions of the kind that may appear in audit events or repository files.
+// Rollback creates resources of a lower Order before, and deletes them after,
+// resources of a higher Order, so kinds must be ordered after the kinds they
+// reference. References lists the field paths naming other objects of the same
+// kind, in the same namespace, which rollback likewise creates first.
+type ResourceType struct {
+	Group          string   `json:"group"`
+	Version        string   `json:"version"`
+	ServedVersions []string `json:"servedVersions,omitempty"`
+	Kind           string   `json:"kind"`
+	Resource       string   `json:"resource"`
+	Dir            string   `json:"dir"`
+	Label          string   `json:"label"`
+	Namespaced     bool     `json:"namespaced"`
+	Order          int      `json:"order,omitempty"`
+	References     []string `json:"references,omitempty"`
+}
+
+func (rt ResourceType) GroupVersionKind() schema.GroupVersionKind {
+	return schema.GroupVersionKind{Group: rt.Group, Version: rt.Version, Kind: rt.Kind}
+}
+
+func (rt ResourceType) ListGroupVersionKind() schema.GroupVersionKind {
+	return schema.GroupVersionKind{Group: rt.Group, Version: rt.Version, Kind: rt.Kind + "List"}
+}
+
+func (rt ResourceType) Versions() []string {
+	return append([]string{rt.Version}, rt.ServedVersions...)
+}
+
+func (rt ResourceType) ServesVersion(version string) bool {
+	return stringInSlice(version, rt.Versions())
+}
+
+// ResourceRegistry is the set of resource types audited by the repository. It is
+// consulted by ingestion, initialization, filtering and rollback.
+type ResourceRegistry struct {
+	Types []ResourceType `json:"resourceTypes"`
+}
+
+var defaultResourceTypes = []ResourceType{
+	{
+		Group:      "networking.k8s.io",
+		Version:    "v1",
+		Kind:       "NetworkPolicy",
+		Resource:   "networkpolicies",
+		Dir:        "k8s-policies",
+		Label:      "K8s network policy",
+		Namespaced: true,
+	},
+	{
+		Group:      "crd.antrea.io",
+		Version:    "v1alpha1",
+		Kind:       "NetworkPolicy",
+		Resource:   "networkpolicies",
+		Dir:        "antrea-policies",
+		Label:      "Antrea network policy",
+		Namespaced: true,
+		Order:      2,
+	},
+	{
+		Group:    "crd.antrea.io",
+		Version:  "v1alpha1",
+		Kind:     "ClusterNetworkPolicy",
+		Resource: "clusternetworkpolicies",
+		Dir:      "antrea-cluster-policies",
+		Label:    "Antrea cluster network policy",
+		Order:    2,
+	},
+	{
+		Group:    "crd.antrea.io",
+		Version:  "v1alpha1",
+		Kind:     "Tier",
+		Resource: "tiers",
+		Dir:      "antrea-tiers",
+		Label:    "Antrea tier",
+	},
+	{
+		Group:          "crd.antrea.io",
+		Version:        "v1alpha3",
+		ServedVersions: []string{"v1alpha2"},
+		Kind:           "ClusterGroup",
+		Resource:       "clustergroups",
+		Dir:            "antrea-cluster-groups",
+		Label:          "Antrea cluster group",
+		Order:          1,
+		References:     []string{".spec.childGroups[*]"},
+	},
+	{
+		Group:      "crd.antrea.io",
+		Version:    "v1alpha3",
+		Kind:       "Group",
+		Resource:   "groups",
+		Dir:        "antrea-groups",
+		Label:      "Antrea group",
+		Namespaced: true,
+		Order:      1,
+		References: []string{".spec.childGroups[*]"},
+	},
+	{
+		Group:    "crd.antrea.io",
+		Version:  "v1alpha2",
+		Kind:     "Egress",
+		Resource: "egresses",
+		Dir:      "antrea-egresses",
+		Label:    "Antrea egress",
+		Order:    1,
+	},
+	{
+		Group:    "crd.antrea.io",
+		Version:  "v1alpha2",
+		Kind:     "ExternalIPPool",
+		Resource: "externalippools",
+		Dir:      "antrea-external-ip-pools",
+		Label:    "Antrea external IP pool",
+	},
+}
+
+var registry = DefaultResourceRegistry()
+
+func DefaultResourceRegistry() *ResourceRegistry {
+	types := make([]ResourceType, len(defaultResourceTypes))
+	for i, rt := range defaultResourceTypes {
+		rt.ServedVersions = append([]string(nil), rt.ServedVersions...)
+		rt.References = append([]string(nil), rt.References...)
+		types[i] = rt
+	}
+	return &ResourceRegistry{Types: types}
+}
+
+// LoadResourceRegistry reads a YAML or JSON file with a top-level resourceTypes
+// list, replacing the default set of audited resources.
+func LoadResourceRegistry(path string) (*ResourceRegistry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read resource registry file: %w", err)
+	}
+	r := &ResourceRegistry{}
+	if err := yaml.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal resource registry: %w", err)
+	}
+	if err := r.validate(); err != nil {
+		return nil, fmt.Errorf("invalid resource registry %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// SetResourceRegistry replaces the registry used by the package. It must be
+// called before the Kubernetes client and repository are set up.
+func SetResourceRegistry(r *ResourceRegistry) {
+	registry = r
+}
+
+func (r *ResourceRegistry) validate() error {
+	if len(r.Types) == 0 {
+		return fmt.Errorf("no resource types defined")
+	}
+	dirs := map[string]bool{}
+	resources := map[string]bool{}
+	kinds := map[string]bool{}
+	for _, rt := range r.Types {
+		if rt.Version == "" || rt.Kind == "" || rt.Resource == "" || rt.Dir == "" || rt.Label == "" {
+			return fmt.Errorf("resource type %s is missing one of version, kind, resource, dir or label", rt.GroupVersionKind().String())
+		}
+		for _, p := range rt.References {
+			if _, err := parseFieldPath(p); err != nil {
+				return fmt.Errorf("invalid reference of resource type %s: %w", rt.GroupVersionKind().String(), err)
+			}
+		}
+		if dirs[rt.Dir] {
+			return fmt.Errorf("directory %s used by more than one resource type", rt.Dir)
+		}
+		if resources[rt.Resource+rt.Group] || kinds[rt.Kind+rt.Group] {
+			return fmt.Errorf("resource type %s defined more than once", rt.GroupVersionKind().GroupKind().String())
+		}
+		dirs[rt.Dir] = true
+		resources[rt.Resource+rt.Group] = true
+		kinds[rt.Kind+rt.Group] = true
+	}
+	return nil
+}
+
+func (r *ResourceRegistry) ByResource(resource string, group string) (ResourceType, bool) {
+	for _, rt := range r.Types {
+		if rt.Resource == resource && rt.Group == group {
+			return rt, true
+		}
+	}
+	return ResourceType{}, false
+}
+
+// ByGroupKind ignores the version so that resources stored under any served
+// version of a kind resolve to the same type.
+func (r *ResourceRegistry) ByGroupKind(group string, kind string) (ResourceType, bool) {
+	for _, rt := range r.Types {
+		if rt.Group == group && rt.Kind == kind {
+			return rt, true
+		}
+	}
+	return ResourceType{}, false
+}
+
+func (r *ResourceRegistry) ByDir(dir string) (ResourceType, bool) {
+	for _, rt := range r.Types {
+		if rt.Dir == dir {
+			return rt, true
+		}
+	}
+	return ResourceType{}, false
+}
+
+// resolveDir maps a user supplied resource filter (directory, plural resource or
+// kind) to a repository directory. Unknown or ambiguous values are returned as-is.
+func (r *ResourceRegistry) resolveDir(resource string) string {
+	if _, ok := r.ByDir(resource); ok {
+		return resource
+	}
+	var matches []string
+	for _, rt := range r.Types {
+		if strings.EqualFold(rt.Resource, resource) || strings.EqualFold(rt.Kind, resource) {
+			matches = append(matches, rt.Dir)
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0]
+	}
+	return resource
+}
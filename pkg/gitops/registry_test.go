@@ -0,0 +1,62 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestLoadResourceRegistry(t *testing.T) {
+	r, err := LoadResourceRegistry("../../reference-manifests/resource-types.yaml")
+	assert.NoError(t, err, "unable to load reference resource registry")
+	assert.Equal(t, DefaultResourceRegistry(), r, "reference manifest should match the built-in defaults")
+
+	rt, ok := r.ByResource("networkpolicies", "crd.antrea.io")
+	assert.True(t, ok, "unable to find Antrea network policies by resource")
+	assert.Equal(t, "antrea-policies", rt.Dir)
+	assert.Equal(t, schema.GroupVersionKind{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "NetworkPolicyList"},
+		rt.ListGroupVersionKind())
+	_, ok = r.ByGroupKind("crd.antrea.io", "Tier")
+	assert.True(t, ok, "unable to find tiers by group/kind")
+	assert.Equal(t, "antrea-cluster-policies", r.resolveDir("ClusterNetworkPolicy"))
+	assert.Equal(t, "antrea-tiers", r.resolveDir("antrea-tiers"))
+	assert.Equal(t, "networkpolicies", r.resolveDir("networkpolicies"), "ambiguous resource should not be resolved")
+
+	tmpDir, err := ioutil.TempDir("", "registry")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	invalid := []string{
+		"resourceTypes: []\n",
+		`resourceTypes:
+- {group: a.io, version: v1, kind: Foo, resource: foos, dir: foos, label: Foo}
+- {group: a.io, version: v1, kind: Bar, resource: bars, dir: foos, label: Bar}
+`,
+		`resourceTypes:
+- {group: a.io, version: v1, kind: Foo, resource: foos, dir: foos}
+`,
+	}
+	for i, content := range invalid {
+		path := filepath.Join(tmpDir, "registry.yaml")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		_, err = LoadResourceRegistry(path)
+		assert.Error(t, err, "invalid registry %d should have been rejected", i)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"k8s.io/klog/v2"
+)
+
+// RevertConflictError is returned when files changed by the reverted commit
+// have been modified again by a later commit.
+type RevertConflictError struct {
+	Paths []string
+}
+
+func (e *RevertConflictError) Error() string {
+	return "revert conflicts with later changes to: " + strings.Join(e.Paths, ", ")
+}
+
+// RevertCommit inverts the changes introduced by commit, leaving every other
+// change made since then in place, and records the result as "Revert <sha>".
+func (cr *CustomRepo) RevertCommit(commit *object.Commit) (string, error) {
+	cr.rollbackMutex.Lock()
+	defer cr.rollbackMutex.Unlock()
+
+	klog.V(2).InfoS("revert initiated, queueing all non-revert generated audits until done",
+		"commit", commit.Hash.String())
+	cr.Mutex.Lock()
+	cr.beginRollbackMode()
+	head, filePatches, resources, err := cr.readRevertPatches(commit)
+	cr.Mutex.Unlock()
+	defer func() {
+		cr.Mutex.Lock()
+		defer cr.Mutex.Unlock()
+		cr.endRollbackMode()
+	}()
+	if err != nil {
+		return "", err
+	}
+
+	message := "Revert " + commit.Hash.String()
+	if err := cr.applyFilePatchesTransaction(head, filePatches, resources, message, nil); err != nil {
+		return "", err
+	}
+	klog.V(2).InfoS("Revert successful", "commit", commit.Hash.String())
+	return commit.Hash.String(), nil
+}
+
+// readRevertPatches returns the HEAD commit, the file patches inverting the
+// changes of commit, and the objects they change. Mutex must be held.
+func (cr *CustomRepo) readRevertPatches(commit *object.Commit) (plumbing.Hash, []diff.FilePatch, patchResources, error) {
+	if commit.NumParents() != 1 {
+		return plumbing.ZeroHash, nil, nil, fmt.Errorf("unable to revert commit %s: only commits with a single parent can be reverted", commit.Hash.String())
+	}
+	parent, err := commit.Parent(0)
+	if err != nil {
+		return plumbing.ZeroHash, nil, nil, fmt.Errorf("unable to get parent of commit %s: %w", commit.Hash.String(), err)
+	}
+	// Paths are mapped to the current layout for commits made before the
+	// cluster-scoped layout migration, so that they can be checked against head
+	patch, err := migratedPatch(commit, parent)
+	if err != nil {
+		return plumbing.ZeroHash, nil, nil, fmt.Errorf("unable to get patch of commit %s: %w", commit.Hash.String(), err)
+	}
+	filePatches := patch.FilePatches()
+	if len(filePatches) == 0 {
+		return plumbing.ZeroHash, nil, nil, fmt.Errorf("commit %s does not change any resources", commit.Hash.String())
+	}
+
+	h, err := cr.Repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, nil, nil, fmt.Errorf("unable to get repo head: %w", err)
+	}
+	headCommit, err := cr.Repo.CommitObject(h.Hash())
+	if err != nil {
+		return plumbing.ZeroHash, nil, nil, fmt.Errorf("unable to get head commit: %w", err)
+	}
+	if err := checkRevertConflicts(headCommit, filePatches); err != nil {
+		return plumbing.ZeroHash, nil, nil, err
+	}
+	resources, err := cr.readPatchResources(filePatches)
+	if err != nil {
+		return plumbing.ZeroHash, nil, nil, err
+	}
+	return h.Hash(), filePatches, resources, nil
+}
+
+// checkRevertConflicts verifies that every file touched by the inverse patch is
+// still in the state the reverted commit left it in at head.
+func checkRevertConflicts(head *object.Commit, filePatches []diff.FilePatch) error {
+	tree, err := head.Tree()
+	if err != nil {
+		return fmt.Errorf("unable to get head tree: %w", err)
+	}
+	var conflicts []string
+	for _, filePatch := range filePatches {
+		fromFile, toFile := filePatch.Files()
+		var path string
+		if fromFile != nil {
+			path = fromFile.Path()
+		} else {
+			path = toFile.Path()
+		}
+		headFile, err := tree.File(path)
+		if errors.Is(err, object.ErrFileNotFound) {
+			headFile = nil
+		} else if err != nil {
+			return fmt.Errorf("unable to read %s at head: %w", path, err)
+		}
+		switch {
+		case fromFile == nil && headFile == nil:
+		case fromFile != nil && headFile != nil && fromFile.Hash() == headFile.Hash:
+		default:
+			conflicts = append(conflicts, path)
+		}
+	}
+	if len(conflicts) > 0 {
+		return &RevertConflictError{Paths: conflicts}
+	}
+	return nil
+}
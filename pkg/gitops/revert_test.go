@@ -0,0 +1,95 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	networkingv1 "k8s.io/api/networking/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestRevertCommit(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+
+	// Mirror the changes recorded in rollback-label-log.txt in the cluster
+	assert.NoError(t, fakeClient.Create(context.TODO(), np2.DeepCopy()))
+	updatedNP := &networkingv1.NetworkPolicy{}
+	assert.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(np1), updatedNP))
+	updatedNP.SetLabels(map[string]string{"updated": "true"})
+	assert.NoError(t, fakeClient.Update(context.TODO(), updatedNP))
+	assert.NoError(t, fakeClient.Delete(context.TODO(), anp1.DeepCopy()))
+	jsonStr, err := ioutil.ReadFile("../../test/files/rollback-label-log.txt")
+	assert.NoError(t, err, "could not read rollback-label-log file")
+	err = cr.HandleEventList(jsonStr)
+	assert.NoError(t, err, "could not process audit events from file")
+
+	// Commits for create npB, patch npA and delete anpA, newest first
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	deleteCommit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	patchCommit, err := deleteCommit.Parent(0)
+	assert.NoError(t, err, "unable to get patch commit")
+	createCommit, err := patchCommit.Parent(0)
+	assert.NoError(t, err, "unable to get create commit")
+
+	// Reverting the delete restores anpA and leaves later changes alone
+	sha, err := cr.RevertCommit(deleteCommit)
+	assert.NoError(t, err, "revert failed")
+	assert.Equal(t, deleteCommit.Hash.String(), sha)
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	revertCommit, err := cr.Repo.CommitObject(newH.Hash())
+	assert.NoError(t, err, "unable to get revert commit object")
+	assert.Equal(t, "Revert "+deleteCommit.Hash.String(), revertCommit.Message)
+	assert.False(t, cr.RollbackMode, "rollback mode not cleared after revert")
+
+	assert.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(anp1), anp1.DeepCopy()),
+		"reverted policy not recreated")
+	_, err = cr.Fs.Stat("antrea-policies/nsA/anpA.yaml")
+	assert.NoError(t, err, "reverted policy not restored in repo")
+	np := &networkingv1.NetworkPolicy{}
+	assert.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(np2), np), "unrelated policy removed")
+
+	// Modify npB again, reverting its creation now conflicts
+	f, err := createCommit.File("k8s-policies/nsA/npB.yaml")
+	assert.NoError(t, err, "unable to find npB in create commit")
+	y, err := cr.readBlob(f.Hash)
+	assert.NoError(t, err, "unable to read npB at create commit")
+	y = append(y, []byte("# modified\n")...)
+	assert.NoError(t, cr.writeFileToPath("k8s-policies/nsA/npB.yaml", y))
+	assert.NoError(t, cr.AddAndCommit("test", "test@antrea.audit.io", "Updated npB"))
+	h, err = cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+
+	_, err = cr.RevertCommit(createCommit)
+	conflictErr := &RevertConflictError{}
+	assert.True(t, errors.As(err, &conflictErr), "expected revert conflict, got: %v", err)
+	assert.Equal(t, []string{"k8s-policies/nsA/npB.yaml"}, conflictErr.Paths)
+	newH, err = cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, h.Hash(), newH.Hash(), "repository head moved after conflicting revert")
+	assert.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(np2), np), "conflicting revert changed cluster")
+}
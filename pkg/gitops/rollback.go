@@ -17,15 +17,21 @@ package gitops
 import (
 	"encoding/json"
 	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/ghodss/yaml"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/diff"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"k8s.io/klog/v2"
 
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"antrea.io/resource-auditing/pkg/types"
 )
 
 func (cr *CustomRepo) TagToCommit(tag string) (*object.Commit, error) {
@@ -57,62 +63,180 @@ func (cr *CustomRepo) HashToCommit(commitSha string) (*object.Commit, error) {
 	return commit, nil
 }
 
-func (cr *CustomRepo) RollbackRepo(targetCommit *object.Commit) (string, error) {
-	cr.Mutex.Lock()
-	defer cr.Mutex.Unlock()
+// RollbackOptions limits a rollback to the repository files matching Resource,
+// Namespace and Name, using the same glob semantics as FilterCommits. The zero
+// value rolls back every audited resource. Force rolls back even if the cluster
+// has diverged from the repository HEAD.
+type RollbackOptions struct {
+	Resource  string
+	Namespace string
+	Name      string
+	Force     bool
+}
 
-	klog.V(2).InfoS("rollback initiated, ignoring all non-rollback generated audits",
-		"targetCommit", targetCommit.Hash.String())
-	cr.RollbackMode = true
+func (o RollbackOptions) isScoped() bool {
+	return o.Resource != "" || o.Namespace != "" || o.Name != ""
+}
 
-	// Get patch between head and target commit
-	w, err := cr.Repo.Worktree()
+func (o RollbackOptions) String() string {
+	return fmt.Sprintf("resource: %s, namespace: %s, name: %s", o.Resource, o.Namespace, o.Name)
+}
+
+// RollbackRepo rolls the cluster and repository back to targetCommit. A failure
+// in any phase restores both the cluster and the repository HEAD.
+func (cr *CustomRepo) RollbackRepo(targetCommit *object.Commit, opts RollbackOptions) (string, error) {
+	return cr.rollbackRepo(targetCommit, opts, nil)
+}
+
+// rollbackRepo holds Mutex only while it reads or writes the repository, so
+// that the history can be queried while the cluster is being rolled back.
+// Nothing else commits in the meantime, as audit events are queued and the
+// watcher and reconciler wait for the end of rollback mode.
+func (cr *CustomRepo) rollbackRepo(targetCommit *object.Commit, opts RollbackOptions, job *RollbackJob) (string, error) {
+	cr.rollbackMutex.Lock()
+	defer cr.rollbackMutex.Unlock()
+
+	klog.V(2).InfoS("rollback initiated, queueing all non-rollback generated audits until done",
+		"targetCommit", targetCommit.Hash.String())
+	cr.Mutex.Lock()
+	cr.beginRollbackMode()
+	head, filePatches, resources, err := cr.readRollbackPatches(targetCommit, opts)
+	cr.Mutex.Unlock()
+	defer func() {
+		cr.Mutex.Lock()
+		defer cr.Mutex.Unlock()
+		cr.endRollbackMode()
+	}()
 	if err != nil {
-		return "", fmt.Errorf("unable to get git worktree from repository: %w", err)
+		return "", err
+	}
+	job.setItems(filePatches)
+	if !opts.Force {
+		if err := cr.detectDrift(filePatches, resources); err != nil {
+			return "", err
+		}
+	}
+
+	message := "Rollback to commit " + targetCommit.Hash.String()
+	if opts.isScoped() {
+		message += "\n\nScope: " + opts.String()
+	}
+	if err := cr.applyFilePatchesTransaction(head, filePatches, resources, message, job); err != nil {
+		return "", err
 	}
+	klog.V(2).InfoS("Rollback successful", "targetCommit", targetCommit.Hash.String())
+	return targetCommit.Hash.String(), nil
+}
+
+// readRollbackPatches returns the HEAD commit, the file patches taking the
+// repository from it to targetCommit, and the objects they change. Mutex must
+// be held.
+func (cr *CustomRepo) readRollbackPatches(targetCommit *object.Commit, opts RollbackOptions) (plumbing.Hash, []diff.FilePatch, patchResources, error) {
 	h, err := cr.Repo.Head()
 	if err != nil {
-		return "", fmt.Errorf("unable to get repo head: %w", err)
+		return plumbing.ZeroHash, nil, nil, fmt.Errorf("unable to get repo head: %w", err)
 	}
-	headCommit, err := cr.Repo.CommitObject(h.Hash())
+	filePatches, err := cr.getRollbackFilePatches(h.Hash(), targetCommit, opts)
 	if err != nil {
-		return "", fmt.Errorf("unable to get head commit: %w", err)
+		return plumbing.ZeroHash, nil, nil, err
 	}
-	patch, err := headCommit.Patch(targetCommit)
+	resources, err := cr.readPatchResources(filePatches)
 	if err != nil {
-		return "", fmt.Errorf("unable to get patch between commits: %w", err)
+		return plumbing.ZeroHash, nil, nil, err
 	}
+	return h.Hash(), filePatches, resources, nil
+}
 
-	// Must do cluster delete requests before resetting in order to be able to read metadata from files
-	if err := cr.doDeletePatch(patch); err != nil {
-		return "", fmt.Errorf("could not patch cluster to old commit state (delete phase): %w", err)
+// applyFilePatchesTransaction applies the file patches to the cluster and the
+// repository, committing them with message. The live state of every object
+// touched is snapshotted first, so that a failure in any phase restores both
+// the cluster and the repository HEAD. Progress is reported to job, if not nil.
+// Mutex is only taken to update the repository, and must not be held.
+func (cr *CustomRepo) applyFilePatchesTransaction(head plumbing.Hash, filePatches []diff.FilePatch, resources patchResources, message string, job *RollbackJob) error {
+	snapshots, err := cr.snapshotPatch(filePatches, resources)
+	if err != nil {
+		return fmt.Errorf("unable to snapshot cluster state before rollback: %w", err)
 	}
+	if err := cr.applyRollback(filePatches, resources, message, job); err != nil {
+		klog.ErrorS(err, "rollback failed, restoring previous cluster and repository state", "head", head.String())
+		if restoreErr := cr.restoreSnapshots(snapshots); restoreErr != nil {
+			err = fmt.Errorf("%w (unable to restore cluster state: %v)", err, restoreErr)
+		}
+		if resetErr := cr.resetHead(head); resetErr != nil {
+			err = fmt.Errorf("%w (unable to restore repository head: %v)", err, resetErr)
+		}
+		return err
+	}
+	return nil
+}
 
-	// Update repo using resets
-	err = resetWorktree(w, targetCommit.Hash, git.HardReset)
+// resetHead discards the changes made to the repository since head.
+func (cr *CustomRepo) resetHead(head plumbing.Hash) error {
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	w, err := cr.Repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("unable to get git worktree from repository: %w", err)
+	}
+	return resetWorktree(w, head, git.HardReset)
+}
+
+// getRollbackFilePatches returns the file patches taking the repository from
+// head to targetCommit, restricted to the files in scope of opts.
+func (cr *CustomRepo) getRollbackFilePatches(head plumbing.Hash, targetCommit *object.Commit, opts RollbackOptions) ([]diff.FilePatch, error) {
+	headCommit, err := cr.Repo.CommitObject(head)
 	if err != nil {
-		return "", fmt.Errorf("unable to hard reset repo: %w", err)
+		return nil, fmt.Errorf("unable to get head commit: %w", err)
 	}
-	err = resetWorktree(w, h.Hash(), git.SoftReset)
+	patch, err := migratedPatch(headCommit, targetCommit)
 	if err != nil {
-		return "", fmt.Errorf("unable to hard reset repo: %w", err)
+		return nil, fmt.Errorf("unable to get patch between commits: %w", err)
+	}
+	if !opts.isScoped() {
+		return patch.FilePatches(), nil
+	}
+	match := pathMatcher(opts.Resource, opts.Namespace, opts.Name)
+	var filePatches []diff.FilePatch
+	for _, filePatch := range patch.FilePatches() {
+		fromFile, toFile := filePatch.Files()
+		if (fromFile != nil && match(fromFile.Path())) || (toFile != nil && match(toFile.Path())) {
+			filePatches = append(filePatches, filePatch)
+		}
+	}
+	return filePatches, nil
+}
+
+func (cr *CustomRepo) applyRollback(filePatches []diff.FilePatch, resources patchResources, message string, job *RollbackJob) error {
+	job.setPhase(types.RollbackPhaseDelete)
+	if err := cr.doDeletePatch(filePatches, resources, job); err != nil {
+		return fmt.Errorf("could not patch cluster to old commit state (delete phase): %w", err)
+	}
+
+	// Update repo files to their state at the target commit
+	job.setPhase(types.RollbackPhaseReset)
+	cr.Mutex.Lock()
+	err := cr.checkoutFilePatches(filePatches)
+	cr.Mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("unable to update repo files: %w", err)
 	}
 
-	// Must similarly do cluster update/create requests after resetting
-	if err := cr.doCreateUpdatePatch(patch); err != nil {
-		return "", fmt.Errorf("could not patch cluster to old commit state (create/update phase): %w", err)
+	job.setPhase(types.RollbackPhaseApply)
+	if err := cr.doCreateUpdatePatch(filePatches, resources, job); err != nil {
+		return fmt.Errorf("could not patch cluster to old commit state (create/update phase): %w", err)
 	}
 
 	// Finally commit changes to repo after cluster updates
+	job.setPhase(types.RollbackPhaseCommit)
 	username := "audit-manager"
 	email := "system@audit.antrea.io"
-	message := "Rollback to commit " + targetCommit.Hash.String()
-	if err := cr.AddAndCommit(username, email, message); err != nil {
-		return "", fmt.Errorf("error while committing rollback: %w", err)
+	cr.Mutex.Lock()
+	err = cr.AddAndCommit(username, email, message)
+	cr.Mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("error while committing rollback: %w", err)
 	}
-	cr.RollbackMode = false
-	klog.V(2).InfoS("Rollback successful", "targetCommit", targetCommit.Hash.String())
-	return targetCommit.Hash.String(), nil
+	return nil
 }
 
 func resetWorktree(w *git.Worktree, hash plumbing.Hash, mode git.ResetMode) error {
@@ -126,36 +250,156 @@ func resetWorktree(w *git.Worktree, hash plumbing.Hash, mode git.ResetMode) erro
 	return nil
 }
 
-func (cr *CustomRepo) doDeletePatch(patch *object.Patch) error {
-	for _, filePatch := range patch.FilePatches() {
+// checkoutFilePatches writes the target side of each file patch to the
+// worktree, removing files that do not exist at the target.
+func (cr *CustomRepo) checkoutFilePatches(filePatches []diff.FilePatch) error {
+	w, err := cr.Repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("unable to get git worktree from repository: %w", err)
+	}
+	for _, filePatch := range filePatches {
 		fromFile, toFile := filePatch.Files()
+		if fromFile != nil && (toFile == nil || toFile.Path() != fromFile.Path()) {
+			if err := cr.removePath(fromFile.Path()); err != nil {
+				return err
+			}
+		}
 		if toFile == nil {
-			path := fromFile.Path()
-			resource, err := cr.getResourceByPath(path)
-			if err != nil {
-				return fmt.Errorf("unable to read resource at path %s: %w", path, err)
+			continue
+		}
+		y, err := cr.readBlob(toFile.Hash())
+		if err != nil {
+			return err
+		}
+		if err := cr.writeFileToPath(toFile.Path(), y); err != nil {
+			return fmt.Errorf("could not write yaml to path %s: %w", toFile.Path(), err)
+		}
+		if _, err := w.Add(toFile.Path()); err != nil {
+			return fmt.Errorf("unable to add file at: %s: %w", toFile.Path(), err)
+		}
+	}
+	return nil
+}
+
+// sortByDependency orders the file patches by the Order of their resource
+// type, then by the references between objects of the same type, ascending for
+// creates and updates or descending for deletes, so that referenced resources
+// such as Tiers or child ClusterGroups exist whenever an object using them does.
+func sortByDependency(filePatches []diff.FilePatch, resources patchResources, descending bool) []diff.FilePatch {
+	depths := referenceDepths(filePatches, resources)
+	sorted := append([]diff.FilePatch(nil), filePatches...)
+	less := func(a diff.FilePatch, b diff.FilePatch) bool {
+		pathA, pathB := patchedFile(a).Path(), patchedFile(b).Path()
+		if orderA, orderB := pathOrder(pathA), pathOrder(pathB); orderA != orderB {
+			return orderA < orderB
+		}
+		return depths[pathA] < depths[pathB]
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if descending {
+			return less(sorted[j], sorted[i])
+		}
+		return less(sorted[i], sorted[j])
+	})
+	return sorted
+}
+
+// referenceDepths returns, by path, the length of the longest chain of objects
+// of the file patches an object references through the References of its
+// resource type. Objects in a reference cycle are given the same depth.
+func referenceDepths(filePatches []diff.FilePatch, resources patchResources) map[string]int {
+	paths := map[string]bool{}
+	for _, filePatch := range filePatches {
+		paths[patchedFile(filePatch).Path()] = true
+	}
+	references := map[string][]string{}
+	for _, filePatch := range filePatches {
+		file := patchedFile(filePatch)
+		dir := strings.SplitN(filepath.ToSlash(file.Path()), "/", 2)[0]
+		resourceType, ok := registry.ByDir(dir)
+		if !ok || len(resourceType.References) == 0 {
+			continue
+		}
+		resource := resources.get(file)
+		for _, p := range resourceType.References {
+			fieldPath, _ := parseFieldPath(p)
+			for _, name := range fieldStrings(resource.Object, fieldPath) {
+				path := computePath("", resourceType.Dir, namespaceDir(resourceType, resource.GetNamespace()), name+".yaml")
+				if paths[path] {
+					references[file.Path()] = append(references[file.Path()], path)
+				}
 			}
+		}
+	}
+	depths := map[string]int{}
+	visiting := map[string]bool{}
+	var depth func(path string) int
+	depth = func(path string) int {
+		if d, ok := depths[path]; ok {
+			return d
+		}
+		if visiting[path] {
+			return 0
+		}
+		visiting[path] = true
+		d := 0
+		for _, reference := range references[path] {
+			if rd := depth(reference) + 1; rd > d {
+				d = rd
+			}
+		}
+		delete(visiting, path)
+		depths[path] = d
+		return d
+	}
+	for path := range paths {
+		depth(path)
+	}
+	return depths
+}
+
+func pathOrder(path string) int {
+	dir := strings.SplitN(filepath.ToSlash(path), "/", 2)[0]
+	resourceType, _ := registry.ByDir(dir)
+	return resourceType.Order
+}
+
+func (cr *CustomRepo) doDeletePatch(filePatches []diff.FilePatch, resources patchResources, job *RollbackJob) error {
+	for _, filePatch := range sortByDependency(filePatches, resources, true) {
+		fromFile, toFile := filePatch.Files()
+		if toFile == nil {
+			path := fromFile.Path()
+			resource := resources.get(fromFile)
 			if err := cr.K8s.DeleteResource(resource); err != nil {
+				job.setItemResult(path, err)
 				return fmt.Errorf("unable to delete resource %s: %w", resource.GetName(), err)
 			}
+			job.setItemResult(path, nil)
 			klog.V(2).InfoS("(rollback) deleted file", "path", path)
 		}
 	}
 	return nil
 }
 
-func (cr *CustomRepo) doCreateUpdatePatch(patch *object.Patch) error {
-	for _, filePatch := range patch.FilePatches() {
+func (cr *CustomRepo) doCreateUpdatePatch(filePatches []diff.FilePatch, resources patchResources, job *RollbackJob) error {
+	for _, filePatch := range sortByDependency(filePatches, resources, false) {
 		_, toFile := filePatch.Files()
 		if toFile != nil {
 			path := toFile.Path()
-			resource, err := cr.getResourceByPath(path)
-			if err != nil {
-				return fmt.Errorf("unable to read resource at path %s: %w", path, err)
+			resource := resources.get(toFile)
+			if err := cr.restoreNormalizedFields(resource); err != nil {
+				job.setItemResult(path, err)
+				return err
+			}
+			if err := cr.restoreRedactedValues(resource); err != nil {
+				job.setItemResult(path, err)
+				return err
 			}
 			if err := cr.K8s.CreateOrUpdateResource(resource); err != nil {
+				job.setItemResult(path, err)
 				return fmt.Errorf("unable to create/update resource %s: %w", resource.GetName(), err)
 			}
+			job.setItemResult(path, nil)
 			klog.V(2).InfoS("(rollback) created/updated file", "path", path)
 		}
 	}
@@ -164,26 +408,30 @@ func (cr *CustomRepo) doCreateUpdatePatch(patch *object.Patch) error {
 
 func (cr *CustomRepo) getResourceByPath(path string) (*unstructured.Unstructured, error) {
 	resource := &unstructured.Unstructured{}
-	gvk := schema.GroupVersionKind{}
 	if err := cr.readResource(resource, path); err != nil {
 		return nil, fmt.Errorf("unable to read resource: %w", err)
 	}
-	apiVersion := resource.GetAPIVersion()
-	kind := resource.GetKind()
-	if apiVersion == "networking.k8s.io/v1" {
-		gvk.Group = "networking.k8s.io"
-		gvk.Version = "v1"
-	} else if apiVersion == "crd.antrea.io/v1alpha1" {
-		gvk.Group = "crd.antrea.io"
-		gvk.Version = "v1alpha1"
-	} else {
-		return nil, fmt.Errorf("unknown apiVersion found: %s", apiVersion)
-	}
-	gvk.Kind = kind
-	resource.SetGroupVersionKind(gvk)
+	if err := setResourceGVK(resource); err != nil {
+		return nil, err
+	}
 	return resource, nil
 }
 
+// setResourceGVK validates the apiVersion/kind read from a repository file
+// against the registry and sets it as the resource's GroupVersionKind.
+func setResourceGVK(resource *unstructured.Unstructured) error {
+	gv, err := schema.ParseGroupVersion(resource.GetAPIVersion())
+	if err != nil {
+		return fmt.Errorf("invalid apiVersion found: %s: %w", resource.GetAPIVersion(), err)
+	}
+	rt, ok := registry.ByGroupKind(gv.Group, resource.GetKind())
+	if !ok || !rt.ServesVersion(gv.Version) {
+		return fmt.Errorf("unknown resource type found: apiVersion: %s, kind: %s", resource.GetAPIVersion(), resource.GetKind())
+	}
+	resource.SetGroupVersionKind(gv.WithKind(resource.GetKind()))
+	return nil
+}
+
 func (cr *CustomRepo) readResource(resource *unstructured.Unstructured, path string) error {
 	var y []byte
 	klog.Info(path)
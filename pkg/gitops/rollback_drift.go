@@ -0,0 +1,113 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/diff"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// DriftError is returned when objects a rollback would change no longer match
+// their version at the repository HEAD, e.g. because they were modified
+// out-of-band or their audit events were dropped.
+type DriftError struct {
+	Paths []string
+}
+
+func (e *DriftError) Error() string {
+	return "cluster has diverged from repository head for: " + strings.Join(e.Paths, ", ")
+}
+
+// detectDrift compares the live state of every object changed by the file
+// patches, which must go from HEAD to the rollback target, with its HEAD version.
+func (cr *CustomRepo) detectDrift(filePatches []diff.FilePatch, resources patchResources) error {
+	var drifted []string
+	for _, filePatch := range filePatches {
+		headFile, _ := filePatch.Files()
+		file := patchedFile(filePatch)
+		resource := resources.get(file)
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(resource.GroupVersionKind())
+		live, err := cr.K8s.GetResource(live, resource.GetNamespace(), resource.GetName())
+		if errors.IsNotFound(err) {
+			live = nil
+		} else if err != nil {
+			return fmt.Errorf("unable to get live state of resource %s: %w", resource.GetName(), err)
+		}
+		var head *unstructured.Unstructured
+		if headFile != nil {
+			head = resources.get(headFile)
+		}
+		match, err := liveMatchesRepo(live, head)
+		if err != nil {
+			return fmt.Errorf("unable to compare resource %s: %w", resource.GetName(), err)
+		}
+		if !match {
+			drifted = append(drifted, file.Path())
+		}
+	}
+	if len(drifted) > 0 {
+		return &DriftError{Paths: drifted}
+	}
+	return nil
+}
+
+// liveMatchesRepo reports whether a live object, normalized the same way as
+// repository files, equals the repository version. Either may be nil when the
+// object does not exist.
+func liveMatchesRepo(live *unstructured.Unstructured, repo *unstructured.Unstructured) (bool, error) {
+	if live == nil || repo == nil {
+		return live == nil && repo == nil, nil
+	}
+	// Round-trip both through JSON so that numbers are compared as the same type.
+	// Repository files are already redacted, only the live object needs to be.
+	normalizedLive := normalizeForCompare(live)
+	redactResource(normalizedLive)
+	liveObject, err := toJSONObject(normalizedLive.Object)
+	if err != nil {
+		return false, err
+	}
+	repoObject, err := toJSONObject(normalizeForCompare(repo).Object)
+	if err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(liveObject, repoObject), nil
+}
+
+// normalizeForCompare applies the repository normalization to a copy of the
+// resource.
+func normalizeForCompare(resource *unstructured.Unstructured) *unstructured.Unstructured {
+	normalized := resource.DeepCopy()
+	normalizeResource(normalized)
+	return normalized
+}
+
+func toJSONObject(object map[string]interface{}) (map[string]interface{}, error) {
+	j, err := json.Marshal(object)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal resource: %w", err)
+	}
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(j, &result); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal resource: %w", err)
+	}
+	return result, nil
+}
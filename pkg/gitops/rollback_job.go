@@ -0,0 +1,189 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"k8s.io/klog/v2"
+
+	"antrea.io/resource-auditing/pkg/types"
+)
+
+// maxRollbackJobs bounds the number of finished jobs kept for status queries.
+const maxRollbackJobs = 100
+
+// RollbackJob tracks the progress of a rollback running in the background. Its
+// unexported methods are no-ops on a nil job, which is how synchronous
+// rollbacks and reverts skip progress reporting.
+type RollbackJob struct {
+	mutex  sync.Mutex
+	status types.RollbackJob
+}
+
+// Status returns a snapshot of the job's progress.
+func (j *RollbackJob) Status() types.RollbackJob {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	status := j.status
+	status.Items = append([]types.RollbackJobItem{}, j.status.Items...)
+	status.Drifted = append([]string(nil), j.status.Drifted...)
+	return status
+}
+
+func (j *RollbackJob) setPhase(phase types.RollbackPhase) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.status.Phase = phase
+	klog.V(2).InfoS("rollback job entered new phase", "id", j.status.ID, "phase", phase)
+}
+
+func (j *RollbackJob) setItems(filePatches []diff.FilePatch) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.status.Items = make([]types.RollbackJobItem, 0, len(filePatches))
+	for _, filePatch := range filePatches {
+		j.status.Items = append(j.status.Items, types.RollbackJobItem{
+			Action: filePatchAction(filePatch),
+			Path:   patchedFile(filePatch).Path(),
+			State:  types.RollbackItemPending,
+		})
+	}
+}
+
+// setItemResult records the outcome of the cluster operation on path.
+func (j *RollbackJob) setItemResult(path string, err error) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	for i := range j.status.Items {
+		if j.status.Items[i].Path != path {
+			continue
+		}
+		if err != nil {
+			j.status.Items[i].State = types.RollbackItemFailed
+			j.status.Items[i].Error = err.Error()
+		} else {
+			j.status.Items[i].State = types.RollbackItemDone
+		}
+	}
+}
+
+func (j *RollbackJob) finish(err error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	now := time.Now()
+	j.status.FinishTime = &now
+	if err == nil {
+		j.status.Phase = types.RollbackPhaseSucceeded
+		return
+	}
+	j.status.Phase = types.RollbackPhaseFailed
+	j.status.Error = err.Error()
+	var driftErr *DriftError
+	if errors.As(err, &driftErr) {
+		j.status.Drifted = driftErr.Paths
+	}
+}
+
+func (j *RollbackJob) finished() bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.status.Finished()
+}
+
+// rollbackJobs keeps the most recent rollback jobs by ID. Its zero value is
+// ready to use.
+type rollbackJobs struct {
+	mutex sync.Mutex
+	byID  map[string]*RollbackJob
+	ids   []string
+}
+
+func (r *rollbackJobs) add(job *RollbackJob) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.byID == nil {
+		r.byID = map[string]*RollbackJob{}
+	}
+	r.byID[job.status.ID] = job
+	r.ids = append(r.ids, job.status.ID)
+	// Forget the oldest finished jobs once over the limit
+	for i := 0; len(r.ids) > maxRollbackJobs && i < len(r.ids); {
+		if !r.byID[r.ids[i]].finished() {
+			i++
+			continue
+		}
+		delete(r.byID, r.ids[i])
+		r.ids = append(r.ids[:i], r.ids[i+1:]...)
+	}
+}
+
+func (r *rollbackJobs) get(id string) (*RollbackJob, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	job, ok := r.byID[id]
+	return job, ok
+}
+
+// StartRollback runs RollbackRepo in the background and returns a job that
+// reports its progress. The job can later be looked up with GetRollbackJob.
+func (cr *CustomRepo) StartRollback(targetCommit *object.Commit, opts RollbackOptions) *RollbackJob {
+	job := &RollbackJob{
+		status: types.RollbackJob{
+			ID:        newRollbackJobID(),
+			TargetSha: targetCommit.Hash.String(),
+			Phase:     types.RollbackPhasePending,
+			Items:     []types.RollbackJobItem{},
+			StartTime: time.Now(),
+		},
+	}
+	cr.rollbackJobs.add(job)
+	go func() {
+		_, err := cr.rollbackRepo(targetCommit, opts, job)
+		if err != nil {
+			klog.ErrorS(err, "rollback job failed", "id", job.status.ID)
+		}
+		job.finish(err)
+	}()
+	return job
+}
+
+func (cr *CustomRepo) GetRollbackJob(id string) (*RollbackJob, bool) {
+	return cr.rollbackJobs.get(id)
+}
+
+func newRollbackJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"antrea.io/resource-auditing/pkg/types"
+)
+
+func setupRollbackJobTest(t *testing.T) (*CustomRepo, *object.Commit) {
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	target, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get target commit")
+
+	assert.NoError(t, fakeClient.Create(context.TODO(), np2.DeepCopy()))
+	assert.NoError(t, fakeClient.Delete(context.TODO(), anp1.DeepCopy()))
+	jsonStr, err := ioutil.ReadFile("../../test/files/rollback-log.txt")
+	assert.NoError(t, err, "could not read rollback-log file")
+	err = cr.HandleEventList(jsonStr)
+	assert.NoError(t, err, "could not process audit events from file")
+	return cr, target
+}
+
+func waitForRollbackJob(t *testing.T, cr *CustomRepo, id string) types.RollbackJob {
+	var status types.RollbackJob
+	assert.Eventually(t, func() bool {
+		job, ok := cr.GetRollbackJob(id)
+		if !ok {
+			return false
+		}
+		status = job.Status()
+		return status.Finished()
+	}, 10*time.Second, 10*time.Millisecond, "rollback job did not finish")
+	return status
+}
+
+func TestRollbackJob(t *testing.T) {
+	cr, target := setupRollbackJobTest(t)
+
+	job := cr.StartRollback(target, RollbackOptions{})
+	status := waitForRollbackJob(t, cr, job.Status().ID)
+	assert.Equal(t, types.RollbackPhaseSucceeded, status.Phase, "rollback job failed: %s", status.Error)
+	assert.Equal(t, target.Hash.String(), status.TargetSha)
+	assert.NotNil(t, status.FinishTime)
+	states := map[string]types.RollbackItemState{}
+	for _, item := range status.Items {
+		states[item.Path] = item.State
+	}
+	assert.Equal(t, map[string]types.RollbackItemState{
+		"antrea-policies/nsA/anpA.yaml": types.RollbackItemDone,
+		"k8s-policies/nsA/npB.yaml":     types.RollbackItemDone,
+	}, states)
+
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	rollbackCommit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get rollback commit object")
+	assert.Equal(t, "Rollback to commit "+target.Hash.String(), rollbackCommit.Message)
+
+	_, ok := cr.GetRollbackJob("unknown")
+	assert.False(t, ok, "unknown rollback job found")
+}
+
+func TestRollbackJobFailure(t *testing.T) {
+	cr, target := setupRollbackJobTest(t)
+	cr.K8s = &K8sClient{
+		Client: &failingClient{Client: cr.K8s.Client, failOn: "anpA"},
+	}
+
+	job := cr.StartRollback(target, RollbackOptions{})
+	status := waitForRollbackJob(t, cr, job.Status().ID)
+	assert.Equal(t, types.RollbackPhaseFailed, status.Phase)
+	assert.Contains(t, status.Error, "injected failure creating anpA")
+	for _, item := range status.Items {
+		if item.Path == "antrea-policies/nsA/anpA.yaml" {
+			assert.Equal(t, types.RollbackItemFailed, item.State)
+			assert.NotEqual(t, "", item.Error)
+		}
+	}
+}
+
+// blockingClient blocks creations until release is closed, to observe the
+// repository while a rollback is in progress.
+type blockingClient struct {
+	client.Client
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	select {
+	case c.blocked <- struct{}{}:
+	default:
+	}
+	<-c.release
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestRollbackJobConcurrentReads(t *testing.T) {
+	cr, target := setupRollbackJobTest(t)
+	blocking := &blockingClient{
+		Client:  cr.K8s.Client,
+		blocked: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	cr.K8s = &K8sClient{Client: blocking}
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+
+	job := cr.StartRollback(target, RollbackOptions{})
+	select {
+	case <-blocking.blocked:
+	case <-time.After(10 * time.Second):
+		t.Fatal("rollback did not reach the create phase")
+	}
+
+	// The history can be read and tagged while the cluster is rolled back
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		commits, err := cr.FilterCommits("", time.Time{}, time.Time{}, "", "", "", ProvenanceFilter{})
+		assert.NoError(t, err, "unable to filter commits during rollback")
+		assert.NotEmpty(t, commits, "no commits returned during rollback")
+		_, err = cr.TagCommit(h.Hash().String(), "during-rollback", &object.Signature{Name: "test", When: time.Now()})
+		assert.NoError(t, err, "unable to tag commit during rollback")
+		_, err = cr.TagToCommit("during-rollback")
+		assert.NoError(t, err, "unable to read tag during rollback")
+		_, err = cr.PlanRollback(target, RollbackOptions{})
+		assert.NoError(t, err, "unable to plan rollback during rollback")
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Error("repository reads blocked by rollback in progress")
+	}
+	close(blocking.release)
+
+	status := waitForRollbackJob(t, cr, job.Status().ID)
+	assert.Equal(t, types.RollbackPhaseSucceeded, status.Phase, "rollback job failed: %s", status.Error)
+}
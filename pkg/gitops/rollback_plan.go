@@ -0,0 +1,109 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"antrea.io/resource-auditing/pkg/types"
+)
+
+// PlanRollback computes the operations RollbackRepo would perform to roll the
+// cluster back to targetCommit, without touching the cluster or the repository.
+func (cr *CustomRepo) PlanRollback(targetCommit *object.Commit, opts RollbackOptions) (*types.RollbackPlan, error) {
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+
+	h, err := cr.Repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get repo head: %w", err)
+	}
+	filePatches, err := cr.getRollbackFilePatches(h.Hash(), targetCommit, opts)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := cr.readPatchResources(filePatches)
+	if err != nil {
+		return nil, err
+	}
+	plan := &types.RollbackPlan{
+		HeadSha:   h.Hash().String(),
+		TargetSha: targetCommit.Hash.String(),
+		Items:     []types.RollbackPlanItem{},
+	}
+	// List items in the order RollbackRepo applies them
+	var deletes, createUpdates []diff.FilePatch
+	for _, filePatch := range filePatches {
+		if _, toFile := filePatch.Files(); toFile == nil {
+			deletes = append(deletes, filePatch)
+		} else {
+			createUpdates = append(createUpdates, filePatch)
+		}
+	}
+	ordered := append(sortByDependency(deletes, resources, true), sortByDependency(createUpdates, resources, false)...)
+	for _, filePatch := range ordered {
+		item, err := planFilePatch(filePatch, resources)
+		if err != nil {
+			return nil, err
+		}
+		plan.Items = append(plan.Items, item)
+	}
+	return plan, nil
+}
+
+func planFilePatch(filePatch diff.FilePatch, resources patchResources) (types.RollbackPlanItem, error) {
+	item := types.RollbackPlanItem{
+		Action: filePatchAction(filePatch),
+	}
+	file := patchedFile(filePatch)
+	item.Path = file.Path()
+	resource := resources.get(file)
+	item.APIVersion = resource.GetAPIVersion()
+	item.Kind = resource.GetKind()
+	item.Namespace = resource.GetNamespace()
+	item.Name = resource.GetName()
+	var buf bytes.Buffer
+	if err := diff.NewUnifiedEncoder(&buf, diff.DefaultContextLines).Encode(filePatchSet{filePatch}); err != nil {
+		return item, fmt.Errorf("unable to encode diff for path %s: %w", file.Path(), err)
+	}
+	item.Diff = buf.String()
+	return item, nil
+}
+
+func filePatchAction(filePatch diff.FilePatch) types.RollbackAction {
+	fromFile, toFile := filePatch.Files()
+	if fromFile == nil {
+		return types.RollbackCreate
+	} else if toFile == nil {
+		return types.RollbackDelete
+	}
+	return types.RollbackUpdate
+}
+
+// filePatchSet adapts a subset of file patches to the diff.Patch interface so
+// they can be encoded on their own.
+type filePatchSet []diff.FilePatch
+
+func (p filePatchSet) FilePatches() []diff.FilePatch {
+	return p
+}
+
+func (p filePatchSet) Message() string {
+	return ""
+}
@@ -0,0 +1,198 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/ghodss/yaml"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/diff"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog/v2"
+)
+
+// resourceSnapshot records the live state of an object before a rollback
+// touched it. live is nil when the object did not exist in the cluster.
+type resourceSnapshot struct {
+	resource *unstructured.Unstructured
+	live     *unstructured.Unstructured
+}
+
+// snapshotPatch fetches the current cluster state of every object changed by
+// the file patches. No cluster change has been made when this returns an error.
+func (cr *CustomRepo) snapshotPatch(filePatches []diff.FilePatch, resources patchResources) ([]resourceSnapshot, error) {
+	var snapshots []resourceSnapshot
+	for _, filePatch := range filePatches {
+		resource := resources.get(patchedFile(filePatch))
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(resource.GroupVersionKind())
+		live, err := cr.K8s.GetResource(live, resource.GetNamespace(), resource.GetName())
+		if errors.IsNotFound(err) {
+			live = nil
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to snapshot resource %s: %w", resource.GetName(), err)
+		}
+		snapshots = append(snapshots, resourceSnapshot{resource: resource, live: live})
+	}
+	return snapshots, nil
+}
+
+// restoreSnapshots puts every snapshotted object back into its pre-rollback
+// state. Objects are recreated or updated in dependency order before objects
+// created by the rollback are deleted in reverse dependency order. It keeps
+// going on failure so that as much of the cluster as possible is restored.
+func (cr *CustomRepo) restoreSnapshots(snapshots []resourceSnapshot) error {
+	var restores, deletes []resourceSnapshot
+	for _, snapshot := range snapshots {
+		if snapshot.live == nil {
+			deletes = append(deletes, snapshot)
+		} else {
+			restores = append(restores, snapshot)
+		}
+	}
+	sort.SliceStable(restores, func(i, j int) bool {
+		return restores[i].order() < restores[j].order()
+	})
+	sort.SliceStable(deletes, func(i, j int) bool {
+		return deletes[i].order() > deletes[j].order()
+	})
+
+	var failed []string
+	for _, snapshot := range append(restores, deletes...) {
+		var err error
+		if snapshot.live == nil {
+			err = cr.K8s.DeleteResource(snapshot.resource.DeepCopy())
+			if errors.IsNotFound(err) {
+				err = nil
+			}
+		} else {
+			err = cr.K8s.CreateOrUpdateResource(prepareForRestore(snapshot.live))
+		}
+		if err != nil {
+			klog.ErrorS(err, "unable to restore resource after failed rollback", "resourceName", snapshot.resource.GetName())
+			failed = append(failed, snapshot.resource.GetNamespace()+"/"+snapshot.resource.GetName())
+			continue
+		}
+		klog.V(2).InfoS("(rollback) restored resource", "resourceName", snapshot.resource.GetName())
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to restore resources %v", failed)
+	}
+	return nil
+}
+
+func (s resourceSnapshot) order() int {
+	gvk := s.resource.GroupVersionKind()
+	resourceType, _ := registry.ByGroupKind(gvk.Group, gvk.Kind)
+	return resourceType.Order
+}
+
+// prepareForRestore strips the server-populated fields of a live object so it
+// can be written back with a create or update.
+func prepareForRestore(live *unstructured.Unstructured) *unstructured.Unstructured {
+	resource := live.DeepCopy()
+	resource.SetUID("")
+	resource.SetResourceVersion("")
+	resource.SetGeneration(0)
+	resource.SetManagedFields(nil)
+	resource.SetCreationTimestamp(metav1.Time{})
+	delete(resource.Object, "status")
+	return resource
+}
+
+// patchedFile returns the side of a file patch describing the object: the
+// target for creates and updates, the source for deletes.
+func patchedFile(filePatch diff.FilePatch) diff.File {
+	fromFile, toFile := filePatch.Files()
+	if toFile != nil {
+		return toFile
+	}
+	return fromFile
+}
+
+func (cr *CustomRepo) readBlob(hash plumbing.Hash) ([]byte, error) {
+	blob, err := cr.Repo.BlobObject(hash)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get blob %s: %w", hash.String(), err)
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read blob %s: %w", hash.String(), err)
+	}
+	defer reader.Close()
+	y, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read blob %s: %w", hash.String(), err)
+	}
+	return y, nil
+}
+
+func (cr *CustomRepo) getResourceByHash(hash plumbing.Hash) (*unstructured.Unstructured, error) {
+	y, err := cr.readBlob(hash)
+	if err != nil {
+		return nil, err
+	}
+	j, err := yaml.YAMLToJSON(y)
+	if err != nil {
+		return nil, fmt.Errorf("error converting from YAML to JSON: %w", err)
+	}
+	resource := &unstructured.Unstructured{}
+	if err := json.Unmarshal(j, &resource.Object); err != nil {
+		return nil, fmt.Errorf("error while unmarshalling blob: %w", err)
+	}
+	if err := setResourceGVK(resource); err != nil {
+		return nil, err
+	}
+	return resource, nil
+}
+
+// patchResources holds the objects on both sides of file patches by blob hash.
+// They are read up front so that the cluster can be changed without holding
+// Mutex.
+type patchResources map[plumbing.Hash]*unstructured.Unstructured
+
+// readPatchResources reads the objects changed by the file patches. Mutex must
+// be held.
+func (cr *CustomRepo) readPatchResources(filePatches []diff.FilePatch) (patchResources, error) {
+	resources := patchResources{}
+	for _, filePatch := range filePatches {
+		fromFile, toFile := filePatch.Files()
+		for _, file := range []diff.File{fromFile, toFile} {
+			if file == nil {
+				continue
+			}
+			if _, ok := resources[file.Hash()]; ok {
+				continue
+			}
+			resource, err := cr.getResourceByHash(file.Hash())
+			if err != nil {
+				return nil, fmt.Errorf("unable to read resource at path %s: %w", file.Path(), err)
+			}
+			resources[file.Hash()] = resource
+		}
+	}
+	return resources, nil
+}
+
+// get returns a copy of the object of a file of the patches.
+func (r patchResources) get(file diff.File) *unstructured.Unstructured {
+	return r[file.Hash()].DeepCopy()
+}
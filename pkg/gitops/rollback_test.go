@@ -15,6 +15,9 @@
 package gitops
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"testing"
 	"time"
@@ -23,10 +26,14 @@ import (
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/stretchr/testify/assert"
 	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"antrea.io/resource-auditing/pkg/types"
 )
 
 var (
@@ -121,8 +128,8 @@ func TestRollback(t *testing.T) {
 	err = k8s.CreateOrUpdateResource(&r)
 	assert.NoError(t, err, "unable to create new resource")
 
-	updatedNP := np1
-	updatedNP.ObjectMeta.SetClusterName("new-cluster-name")
+	updatedNP := np1.DeepCopy()
+	updatedNP.SetLabels(map[string]string{"updated": "true"})
 	r = unstructured.Unstructured{}
 	r.SetGroupVersionKind(schema.GroupVersionKind{
 		Group:   "networking.k8s.io",
@@ -145,15 +152,15 @@ func TestRollback(t *testing.T) {
 	err = k8s.DeleteResource(&r)
 	assert.NoError(t, err, "unable to delete resource")
 
-	jsonStr, err := ioutil.ReadFile("../../test/files/rollback-log.txt")
-	assert.NoError(t, err, "could not read rollback-log file")
+	jsonStr, err := ioutil.ReadFile("../../test/files/rollback-label-log.txt")
+	assert.NoError(t, err, "could not read rollback-label-log file")
 	err = cr.HandleEventList(jsonStr)
 	assert.NoError(t, err, "could not process audit events from file")
 
 	// Attempt rollback
 	commit, err := cr.TagToCommit("test-tag")
 	assert.NoError(t, err, "could not retrieve commit from tag")
-	_, err = cr.RollbackRepo(commit)
+	_, err = cr.RollbackRepo(commit, RollbackOptions{})
 	assert.NoError(t, err, "rollback failed")
 
 	// Check latest commit
@@ -173,8 +180,8 @@ func TestRollback(t *testing.T) {
 	})
 	np, err := k8s.GetResource(res, "nsA", "npA")
 	assert.NoError(t, err, "unable to get policy after rollback")
-	assert.Equal(t, "", np.GetClusterName(),
-		"Error (TestRollback): updated field should be empty after rollback")
+	assert.NotContains(t, np.GetLabels(), "updated",
+		"Error (TestRollback): updated label should be removed after rollback")
 
 	res = &unstructured.Unstructured{}
 	res.SetGroupVersionKind(schema.GroupVersionKind{
@@ -185,3 +192,347 @@ func TestRollback(t *testing.T) {
 	_, err = k8s.GetResource(res, "nsA", "anpA")
 	assert.NoError(t, err, "unable to get antrea policy after rollback")
 }
+
+func TestGetResourceByPath(t *testing.T) {
+	k8s := &K8sClient{
+		Client: NewClient(),
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+
+	// ClusterGroups may be stored under any served version
+	err = cr.writeFileToPath("antrea-cluster-groups/cgA.yaml", []byte(`apiVersion: crd.antrea.io/v1alpha2
+kind: ClusterGroup
+metadata:
+  name: cgA
+spec:
+  podSelector: {}
+`))
+	assert.NoError(t, err, "unable to write cluster group")
+	resource, err := cr.getResourceByPath("antrea-cluster-groups/cgA.yaml")
+	assert.NoError(t, err, "unable to resolve cluster group")
+	assert.Equal(t, schema.GroupVersionKind{Group: "crd.antrea.io", Version: "v1alpha2", Kind: "ClusterGroup"},
+		resource.GroupVersionKind())
+
+	err = cr.writeFileToPath("antrea-egresses/egressA.yaml", []byte(`apiVersion: crd.antrea.io/v1beta9
+kind: Egress
+metadata:
+  name: egressA
+`))
+	assert.NoError(t, err, "unable to write egress")
+	_, err = cr.getResourceByPath("antrea-egresses/egressA.yaml")
+	assert.Error(t, err, "should have returned error on unserved version")
+}
+
+// failingClient fails creations of the named resource to simulate a rollback
+// that breaks halfway through.
+type failingClient struct {
+	client.Client
+	failOn string
+}
+
+func (c *failingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if obj.GetName() == c.failOn {
+		return fmt.Errorf("injected failure creating %s", c.failOn)
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestRollbackCompensation(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	target, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get target commit")
+
+	// Mirror the changes recorded in rollback-log.txt in the cluster
+	assert.NoError(t, fakeClient.Create(context.TODO(), np2.DeepCopy()))
+	assert.NoError(t, fakeClient.Delete(context.TODO(), anp1.DeepCopy()))
+	jsonStr, err := ioutil.ReadFile("../../test/files/rollback-log.txt")
+	assert.NoError(t, err, "could not read rollback-log file")
+	err = cr.HandleEventList(jsonStr)
+	assert.NoError(t, err, "could not process audit events from file")
+	h, err = cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+
+	// Deleting npB succeeds, recreating anpA fails
+	cr.K8s = &K8sClient{
+		Client: &failingClient{Client: fakeClient, failOn: "anpA"},
+	}
+	_, err = cr.RollbackRepo(target, RollbackOptions{})
+	assert.Error(t, err, "rollback should have failed")
+	assert.False(t, cr.RollbackMode, "rollback mode not cleared after failure")
+
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, h.Hash(), newH.Hash(), "repository head moved after failed rollback")
+	w, err := cr.Repo.Worktree()
+	assert.NoError(t, err, "unable to get worktree")
+	status, err := w.Status()
+	assert.NoError(t, err, "unable to get worktree status")
+	assert.True(t, status.IsClean(), "worktree not restored after failed rollback: %s", status.String())
+
+	res := &unstructured.Unstructured{}
+	res.SetGroupVersionKind(schema.GroupVersionKind{
+		Group:   "networking.k8s.io",
+		Version: "v1",
+		Kind:    "NetworkPolicy",
+	})
+	_, err = k8s.GetResource(res, "nsA", "npB")
+	assert.NoError(t, err, "deleted policy not restored after failed rollback")
+}
+
+func TestPlanRollback(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	target, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get target commit")
+
+	jsonStr, err := ioutil.ReadFile("../../test/files/rollback-label-log.txt")
+	assert.NoError(t, err, "could not read rollback-label-log file")
+	err = cr.HandleEventList(jsonStr)
+	assert.NoError(t, err, "could not process audit events from file")
+	h, err = cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+
+	plan, err := cr.PlanRollback(target, RollbackOptions{})
+	assert.NoError(t, err, "unable to plan rollback")
+	assert.Equal(t, h.Hash().String(), plan.HeadSha)
+	assert.Equal(t, target.Hash.String(), plan.TargetSha)
+	actions := map[string]types.RollbackAction{}
+	for _, item := range plan.Items {
+		actions[item.Path] = item.Action
+		assert.NotEqual(t, "", item.Diff, "plan item for %s has no diff", item.Path)
+	}
+	assert.Equal(t, map[string]types.RollbackAction{
+		"antrea-policies/nsA/anpA.yaml": types.RollbackCreate,
+		"k8s-policies/nsA/npA.yaml":     types.RollbackUpdate,
+		"k8s-policies/nsA/npB.yaml":     types.RollbackDelete,
+	}, actions)
+
+	// Planning must not touch the repository or the cluster
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, h.Hash(), newH.Hash(), "planning moved repository head")
+	assert.False(t, cr.RollbackMode, "planning entered rollback mode")
+	res := &unstructured.Unstructured{}
+	res.SetGroupVersionKind(schema.GroupVersionKind{
+		Group:   "crd.antrea.io",
+		Version: "v1alpha1",
+		Kind:    "NetworkPolicy",
+	})
+	_, err = k8s.GetResource(res, "nsA", "anpA")
+	assert.NoError(t, err, "planning changed cluster state")
+}
+
+func TestScopedRollback(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	target, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get target commit")
+
+	assert.NoError(t, fakeClient.Create(context.TODO(), np2.DeepCopy()))
+	updatedNP := &networkingv1.NetworkPolicy{}
+	assert.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(np1), updatedNP))
+	updatedNP.SetLabels(map[string]string{"updated": "true"})
+	assert.NoError(t, fakeClient.Update(context.TODO(), updatedNP))
+	assert.NoError(t, fakeClient.Delete(context.TODO(), anp1.DeepCopy()))
+	jsonStr, err := ioutil.ReadFile("../../test/files/rollback-label-log.txt")
+	assert.NoError(t, err, "could not read rollback-label-log file")
+	err = cr.HandleEventList(jsonStr)
+	assert.NoError(t, err, "could not process audit events from file")
+
+	// Only roll back npA
+	opts := RollbackOptions{Resource: "k8s-policies", Namespace: "nsA", Name: "npA.yaml"}
+	plan, err := cr.PlanRollback(target, opts)
+	assert.NoError(t, err, "unable to plan scoped rollback")
+	assert.Equal(t, 1, len(plan.Items), "scoped plan should only contain npA")
+	_, err = cr.RollbackRepo(target, opts)
+	assert.NoError(t, err, "scoped rollback failed")
+
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	rollbackCommit, err := cr.Repo.CommitObject(newH.Hash())
+	assert.NoError(t, err, "unable to get rollback commit object")
+	assert.Equal(t, "Rollback to commit "+target.Hash.String()+"\n\nScope: "+opts.String(), rollbackCommit.Message)
+
+	np := &networkingv1.NetworkPolicy{}
+	assert.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(np1), np))
+	assert.NotContains(t, np.GetLabels(), "updated", "npA not rolled back")
+	assert.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(np2), np), "npB out of scope but removed")
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npB.yaml")
+	assert.NoError(t, err, "npB out of scope but removed from repo")
+	_, err = cr.Fs.Stat("antrea-policies/nsA/anpA.yaml")
+	assert.Error(t, err, "anpA out of scope but restored in repo")
+}
+
+func TestRollbackDrift(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	target, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get target commit")
+
+	assert.NoError(t, fakeClient.Create(context.TODO(), np2.DeepCopy()))
+	assert.NoError(t, fakeClient.Delete(context.TODO(), anp1.DeepCopy()))
+	jsonStr, err := ioutil.ReadFile("../../test/files/rollback-log.txt")
+	assert.NoError(t, err, "could not read rollback-log file")
+	err = cr.HandleEventList(jsonStr)
+	assert.NoError(t, err, "could not process audit events from file")
+	h, err = cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+
+	// Change npB without an audit event
+	driftedNP := &networkingv1.NetworkPolicy{}
+	assert.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(np2), driftedNP))
+	driftedNP.SetLabels(map[string]string{"drifted": "true"})
+	assert.NoError(t, fakeClient.Update(context.TODO(), driftedNP))
+
+	_, err = cr.RollbackRepo(target, RollbackOptions{})
+	driftErr := &DriftError{}
+	assert.True(t, errors.As(err, &driftErr), "expected drift error, got: %v", err)
+	assert.Equal(t, []string{"k8s-policies/nsA/npB.yaml"}, driftErr.Paths)
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, h.Hash(), newH.Hash(), "repository head moved after refused rollback")
+	assert.NoError(t, fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(np2), driftedNP),
+		"refused rollback changed cluster")
+
+	_, err = cr.RollbackRepo(target, RollbackOptions{Force: true})
+	assert.NoError(t, err, "forced rollback failed")
+	err = fakeClient.Get(context.TODO(), client.ObjectKeyFromObject(np2), driftedNP)
+	assert.True(t, apierrors.IsNotFound(err), "drifted policy not deleted by forced rollback")
+}
+
+// recordingClient records the kind and the name of every object created or
+// deleted.
+type recordingClient struct {
+	client.Client
+	calls []string
+	names []string
+}
+
+func (c *recordingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	c.calls = append(c.calls, "create "+obj.GetObjectKind().GroupVersionKind().Kind)
+	c.names = append(c.names, "create "+obj.GetName())
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *recordingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	c.calls = append(c.calls, "delete "+obj.GetObjectKind().GroupVersionKind().Kind)
+	c.names = append(c.names, "delete "+obj.GetName())
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+func TestRollbackDependencyOrder(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	target, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get target commit")
+
+	// Add a cluster policy in a new tier
+	tier := Tier1.inputResource.(*crdv1alpha1.Tier).DeepCopy()
+	tier.SetResourceVersion("")
+	cnp := Acnp1.inputResource.(*crdv1alpha1.ClusterNetworkPolicy).DeepCopy()
+	cnp.SetResourceVersion("")
+	cnp.Spec.Tier = "TierA"
+	assert.NoError(t, fakeClient.Create(context.TODO(), tier))
+	assert.NoError(t, fakeClient.Create(context.TODO(), cnp))
+	assert.NoError(t, cr.Reconcile(), "unable to record tier and policy")
+	h, err = cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	withTier, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get commit with tier")
+
+	// The policy must be deleted before its tier
+	recorder := &recordingClient{Client: fakeClient}
+	cr.K8s = &K8sClient{Client: recorder}
+	_, err = cr.RollbackRepo(target, RollbackOptions{})
+	assert.NoError(t, err, "rollback failed")
+	assert.Equal(t, []string{"delete ClusterNetworkPolicy", "delete Tier"}, recorder.calls)
+
+	// ...and created after it
+	recorder.calls = nil
+	_, err = cr.RollbackRepo(withTier, RollbackOptions{})
+	assert.NoError(t, err, "rollback failed")
+	assert.Equal(t, []string{"create Tier", "create ClusterNetworkPolicy"}, recorder.calls)
+}
+
+func TestRollbackReferenceOrder(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	target, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get target commit")
+
+	// Add a chain of cluster groups, each the child of the previous one, named
+	// so that they do not sort in reference order
+	clusterGroup := func(name string, children ...interface{}) *unstructured.Unstructured {
+		spec := map[string]interface{}{}
+		if len(children) > 0 {
+			spec["childGroups"] = children
+		} else {
+			spec["podSelector"] = map[string]interface{}{}
+		}
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "crd.antrea.io/v1alpha3",
+			"kind":       "ClusterGroup",
+			"metadata":   map[string]interface{}{"name": name},
+			"spec":       spec,
+		}}
+	}
+	assert.NoError(t, fakeClient.Create(context.TODO(), clusterGroup("cgA", "cgC")))
+	assert.NoError(t, fakeClient.Create(context.TODO(), clusterGroup("cgC", "cgB")))
+	assert.NoError(t, fakeClient.Create(context.TODO(), clusterGroup("cgB")))
+	assert.NoError(t, cr.Reconcile(), "unable to record cluster groups")
+	h, err = cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	withGroups, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get commit with cluster groups")
+
+	// Parents are deleted before their children...
+	recorder := &recordingClient{Client: fakeClient}
+	cr.K8s = &K8sClient{Client: recorder}
+	_, err = cr.RollbackRepo(target, RollbackOptions{})
+	assert.NoError(t, err, "rollback failed")
+	assert.Equal(t, []string{"delete cgA", "delete cgC", "delete cgB"}, recorder.names)
+
+	// ...and created after them
+	recorder.names = nil
+	_, err = cr.RollbackRepo(withGroups, RollbackOptions{})
+	assert.NoError(t, err, "rollback failed")
+	assert.Equal(t, []string{"create cgB", "create cgC", "create cgA"}, recorder.names)
+}
@@ -17,6 +17,8 @@ package gitops
 import (
 	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/ghodss/yaml"
@@ -24,9 +26,17 @@ import (
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 func (cr *CustomRepo) AddAndCommit(username string, email string, message string) error {
+	return cr.addAndCommitAt(username, email, message, time.Now())
+}
+
+// addAndCommitAt commits the worktree with an author time of when, typically
+// the time the change was made in the cluster. The committer time is always the
+// time the commit is created.
+func (cr *CustomRepo) addAndCommitAt(username string, email string, message string, when time.Time) error {
 	w, err := cr.Repo.Worktree()
 	if err != nil {
 		return fmt.Errorf("unable to get git worktree from repository: %w", err)
@@ -37,6 +47,11 @@ func (cr *CustomRepo) AddAndCommit(username string, email string, message string
 	}
 	_, err = w.Commit(message, &git.CommitOptions{
 		Author: &object.Signature{
+			Name:  username,
+			Email: email,
+			When:  when,
+		},
+		Committer: &object.Signature{
 			Name:  username,
 			Email: email,
 			When:  time.Now(),
@@ -49,14 +64,9 @@ func (cr *CustomRepo) AddAndCommit(username string, email string, message string
 }
 
 func (cr *CustomRepo) modifyFile(event auditv1.Event) error {
-	resource := unstructured.Unstructured{}
-	if err := json.Unmarshal(event.ResponseObject.Raw, &resource); err != nil {
-		return fmt.Errorf("unable to unmarshal ResponseObject resource config: %w", err)
-	}
-	clearFields(&resource)
-	y, err := yaml.Marshal(&resource)
+	y, err := eventResourceYAML(event)
 	if err != nil {
-		return fmt.Errorf("unable to marshal new resource config: %w", err)
+		return err
 	}
 	path := getAbsRepoPath("", event)
 	path += getFileName(event)
@@ -69,15 +79,96 @@ func (cr *CustomRepo) modifyFile(event auditv1.Event) error {
 	return nil
 }
 
+// eventResourceYAML returns the repository file content of the object returned
+// by the request of an audit event.
+func eventResourceYAML(event auditv1.Event) ([]byte, error) {
+	if event.ResponseObject == nil {
+		return nil, fmt.Errorf("audit event has no ResponseObject")
+	}
+	resource := unstructured.Unstructured{}
+	if err := json.Unmarshal(event.ResponseObject.Raw, &resource); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal ResponseObject resource config: %w", err)
+	}
+	normalizeResource(&resource)
+	redactResource(&resource)
+	y, err := yaml.Marshal(&resource)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal new resource config: %w", err)
+	}
+	return y, nil
+}
+
 func (cr *CustomRepo) deleteFile(event auditv1.Event) error {
+	return cr.removePath(getRelRepoPath(event) + getFileName(event))
+}
+
+func (cr *CustomRepo) removePath(path string) error {
 	w, err := cr.Repo.Worktree()
 	if err != nil {
 		return fmt.Errorf("unable to get git worktree from repository: %w", err)
 	}
-	path := getRelRepoPath(event) + getFileName(event)
 	_, err = w.Remove(path)
 	if err != nil {
 		return fmt.Errorf("unable to remove file at: %s: %w", path, err)
 	}
 	return nil
 }
+
+// getDeletedPaths expands a deletecollection event into the repository files of
+// the objects it removed. The audit event only names the namespace/resource, so
+// files in that directory are compared against what is still live in the cluster.
+func (cr *CustomRepo) getDeletedPaths(event auditv1.Event) ([]string, error) {
+	resourceType, ok := getEventResourceType(event)
+	if !ok {
+		return nil, fmt.Errorf("unknown resource type %s in group %s", event.ObjectRef.Resource, event.ObjectRef.APIGroup)
+	}
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(resourceType.ListGroupVersionKind())
+	var opts []client.ListOption
+	if resourceType.Namespaced && event.ObjectRef.Namespace != "" {
+		opts = append(opts, client.InNamespace(event.ObjectRef.Namespace))
+	}
+	resources, err := cr.K8s.ListResource(list, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list remaining resources: %w", err)
+	}
+	live := map[string]bool{}
+	for _, resource := range resources.Items {
+		live[resource.GetNamespace()+"/"+resource.GetName()] = true
+	}
+	files, err := cr.listFiles(getRelRepoPath(event))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list repository files: %w", err)
+	}
+	var deleted []string
+	for _, path := range files {
+		namespace, name := pathToNamespacedName(path)
+		if !live[namespace+"/"+name] {
+			deleted = append(deleted, path)
+		}
+	}
+	return deleted, nil
+}
+
+func (cr *CustomRepo) listFiles(dir string) ([]string, error) {
+	infos, err := cr.Fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read directory %s: %w", dir, err)
+	}
+	var files []string
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if info.IsDir() {
+			subFiles, err := cr.listFiles(path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, subFiles...)
+		} else if filepath.Ext(path) == ".yaml" {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
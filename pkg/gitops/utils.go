@@ -15,58 +15,100 @@
 package gitops
 
 import (
+	"encoding/json"
 	"path/filepath"
+	"strings"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
 )
 
-var dirMap = map[string]string{
-	"networkpoliciesnetworking.k8s.io":    "k8s-policies",
-	"networkpoliciescrd.antrea.io":        "antrea-policies",
-	"clusternetworkpoliciescrd.antrea.io": "antrea-cluster-policies",
-	"tierscrd.antrea.io":                  "antrea-tiers",
+func computePath(dir string, resource string, namespace string, file string) string {
+	return filepath.Join(dir, resource, namespace, file)
 }
 
-var resourceMap = map[string]string{
-	"networkpoliciesnetworking.k8s.io":    "K8s network policy ",
-	"networkpoliciescrd.antrea.io":        "Antrea network policy ",
-	"clusternetworkpoliciescrd.antrea.io": "Antrea cluster network policy ",
-	"tierscrd.antrea.io":                  "Antrea tier ",
+func getEventResourceType(event auditv1.Event) (ResourceType, bool) {
+	return registry.ByResource(event.ObjectRef.Resource, event.ObjectRef.APIGroup)
 }
 
-func computePath(dir string, resource string, namespace string, file string) string {
-	return filepath.Join(dir, resource, namespace, file)
+// clusterScopeDir is the directory holding the objects of a cluster-scoped
+// resource type, in place of a namespace directory.
+const clusterScopeDir = "_cluster"
+
+// namespaceDir returns the directory of a namespace within the directory of a
+// resource type, or clusterScopeDir for cluster-scoped resource types.
+func namespaceDir(resourceType ResourceType, namespace string) string {
+	if !resourceType.Namespaced {
+		return clusterScopeDir
+	}
+	return namespace
 }
 
 func getAbsRepoPath(dir string, event auditv1.Event) string {
-	resource := dirMap[event.ObjectRef.Resource+event.ObjectRef.APIGroup]
-	namespace := event.ObjectRef.Namespace
+	resourceType, _ := getEventResourceType(event)
+	resource := resourceType.Dir
+	namespace := namespaceDir(resourceType, event.ObjectRef.Namespace)
 	return computePath(dir, resource, namespace, "")
 }
 
 func getRelRepoPath(event auditv1.Event) string {
-	resource := dirMap[event.ObjectRef.Resource+event.ObjectRef.APIGroup]
-	namespace := event.ObjectRef.Namespace
+	resourceType, _ := getEventResourceType(event)
+	resource := resourceType.Dir
+	namespace := namespaceDir(resourceType, event.ObjectRef.Namespace)
 	path := computePath("", resource, namespace, "")
 	return path
 }
 
-func getFileName(event auditv1.Event) string {
-	return "/" + event.ObjectRef.Name + ".yaml"
+// pathToNamespacedName extracts the namespace and name from a repository path of
+// the form resource/namespace/name.yaml; namespace is empty for cluster-scoped
+// resources stored as resource/_cluster/name.yaml, or resource/name.yaml in
+// repositories created before the _cluster directory was introduced.
+func pathToNamespacedName(path string) (string, string) {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	name := strings.TrimSuffix(parts[len(parts)-1], ".yaml")
+	if len(parts) < 3 || parts[len(parts)-2] == clusterScopeDir {
+		return "", name
+	}
+	return parts[len(parts)-2], name
 }
 
-func clearFields(resource *unstructured.Unstructured) {
-	resource.SetUID("")
-	resource.SetGeneration(0)
-	resource.SetManagedFields(nil)
-	resource.SetCreationTimestamp(metav1.Time{})
-	resource.SetResourceVersion("")
-	annotations := resource.GetAnnotations()
-	delete(annotations, "kubectl.kubernetes.io/last-applied-configuration")
-	resource.SetAnnotations(annotations)
-	delete(resource.Object, "status")
+// namespacedName returns namespace/name, or name for cluster-scoped objects.
+func namespacedName(namespace string, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// withResponseIdentity completes the object reference of an audit event with the
+// name and namespace of the object returned by the request. The reference of a
+// create request using metadata.generateName has no name, as the name is only
+// known once the object is created.
+func withResponseIdentity(event auditv1.Event) auditv1.Event {
+	if event.ObjectRef == nil || event.ResponseObject == nil {
+		return event
+	}
+	resourceType, ok := getEventResourceType(event)
+	if event.ObjectRef.Name != "" && (event.ObjectRef.Namespace != "" || !ok || !resourceType.Namespaced) {
+		return event
+	}
+	var object metav1.PartialObjectMetadata
+	if err := json.Unmarshal(event.ResponseObject.Raw, &object); err != nil || object.Kind == "Status" {
+		return event
+	}
+	ref := *event.ObjectRef
+	if ref.Name == "" {
+		ref.Name = object.Name
+	}
+	if ref.Namespace == "" && ok && resourceType.Namespaced {
+		ref.Namespace = object.Namespace
+	}
+	event.ObjectRef = &ref
+	return event
+}
+
+func getFileName(event auditv1.Event) string {
+	return "/" + event.ObjectRef.Name + ".yaml"
 }
 
 func stringInSlice(a string, list []string) bool {
@@ -0,0 +1,256 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/go-git/go-billy/v5/util"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"antrea.io/resource-auditing/pkg/types"
+)
+
+// unknownAuthor is the author of changes whose actor is not known, such as
+// deletions observed by watching the cluster.
+const unknownAuthor = "unknown-actor"
+
+// rollbackRequeueDelay is the delay before an object changed during a rollback
+// is looked at again.
+const rollbackRequeueDelay = time.Second
+
+// watchKey identifies an object of an audited resource type.
+type watchKey struct {
+	dir       string
+	namespace string
+	name      string
+}
+
+type watcher struct {
+	cr        *CustomRepo
+	informers map[string]informers.GenericInformer
+	queue     workqueue.RateLimitingInterface
+	delay     time.Duration
+	// correlate is set when audit events are received as well.
+	correlate bool
+}
+
+// RunWatcher commits the changes to audited resources observed with
+// informers, for clusters where the API server cannot be configured to send
+// audit events. The author of a change is the field manager that last wrote the
+// object. A positive delay is the window in which audit events are expected as
+// well: a change is usually committed from its audit event first, with its full
+// provenance, and the watcher then finds nothing left to commit. Changes still
+// uncommitted after delay, e.g. because a batch of audit events was dropped,
+// are committed as unattributed by unknownAuthor, and attributed once their
+// audit event arrives. It runs until stopCh is closed.
+func (cr *CustomRepo) RunWatcher(dynamicClient dynamic.Interface, delay time.Duration, stopCh <-chan struct{}) error {
+	w := &watcher{
+		cr:        cr,
+		informers: map[string]informers.GenericInformer{},
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		delay:     delay,
+		correlate: delay > 0,
+	}
+	defer w.queue.ShutDown()
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+	var synced []cache.InformerSynced
+	for _, resourceType := range registry.Types {
+		served, err := cr.resourceTypeServed(resourceType)
+		if err != nil {
+			return err
+		} else if !served {
+			continue
+		}
+		resourceType := resourceType
+		gvr := schema.GroupVersionResource{Group: resourceType.Group, Version: resourceType.Version, Resource: resourceType.Resource}
+		informer := factory.ForResource(gvr)
+		informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { w.enqueue(resourceType, obj) },
+			UpdateFunc: func(_, obj interface{}) { w.enqueue(resourceType, obj) },
+			DeleteFunc: func(obj interface{}) { w.enqueue(resourceType, obj) },
+		})
+		w.informers[resourceType.Dir] = informer
+		synced = append(synced, informer.Informer().HasSynced)
+	}
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, synced...) {
+		return fmt.Errorf("unable to sync informers for audited resources")
+	}
+	klog.V(2).InfoS("watching audited resources", "delay", delay)
+	go func() {
+		<-stopCh
+		w.queue.ShutDown()
+	}()
+	for w.processNext() {
+	}
+	return nil
+}
+
+func (w *watcher) enqueue(resourceType ResourceType, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	resource, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	w.queue.AddAfter(watchKey{dir: resourceType.Dir, namespace: resource.GetNamespace(), name: resource.GetName()}, w.delay)
+}
+
+// processNext commits the current state of the next object in the queue,
+// reporting false once the queue is shut down. The state is read from the
+// informer cache rather than taken from the event, so that transient states,
+// e.g. during a rollback, are not committed. An object that cannot be committed
+// is queued again with backoff.
+func (w *watcher) processNext() bool {
+	item, shutdown := w.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer w.queue.Done(item)
+	key := item.(watchKey)
+	storeKey := key.name
+	if key.namespace != "" {
+		storeKey = key.namespace + "/" + key.name
+	}
+	var resource *unstructured.Unstructured
+	obj, exists, err := w.informers[key.dir].Informer().GetIndexer().GetByKey(storeKey)
+	if err != nil {
+		klog.ErrorS(err, "unable to get watched resource from cache, retrying", "key", storeKey)
+		w.queue.AddRateLimited(item)
+		return true
+	} else if exists {
+		resource = obj.(*unstructured.Unstructured).DeepCopy()
+	}
+	resourceType, _ := registry.ByDir(key.dir)
+	w.cr.Mutex.Lock()
+	defer w.cr.Mutex.Unlock()
+	if w.cr.RollbackMode {
+		// Commit the state the rollback leaves the object in
+		w.queue.AddAfter(item, rollbackRequeueDelay)
+		return true
+	}
+	if err := w.cr.commitWatchedResource(resourceType, key.namespace, key.name, resource, w.correlate); err != nil {
+		klog.ErrorS(err, "unable to commit watched resource, retrying", "key", storeKey)
+		w.queue.AddRateLimited(item)
+		return true
+	}
+	w.queue.Forget(item)
+	return true
+}
+
+// commitWatchedResource records the state of an object in the repository, nil
+// meaning that it no longer exists, unless the repository already holds that
+// state. With correlate, the change is committed as unattributed, to be
+// attributed by its audit event. Mutex must be held.
+func (cr *CustomRepo) commitWatchedResource(resourceType ResourceType, namespace string, name string, resource *unstructured.Unstructured, correlate bool) error {
+	path := computePath("", resourceType.Dir, namespaceDir(resourceType, namespace), name+".yaml")
+	old, err := util.ReadFile(cr.Fs, path)
+	existed := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read file at %s: %w", path, err)
+	}
+	message := resourceType.Label + " " + namespacedName(namespace, name)
+	author, when := unknownAuthor, time.Now()
+	provenance := types.Provenance{Unattributed: correlate}
+	if resource == nil {
+		if !existed {
+			return nil
+		}
+		if err := cr.removePath(path); err != nil {
+			return err
+		}
+		message = "Deleted " + message
+	} else {
+		author, when = lastFieldManager(resource)
+		provenance.ResourceVersion = resource.GetResourceVersion()
+		normalizeResource(resource)
+		redactResource(resource)
+		y, err := yaml.Marshal(resource)
+		if err != nil {
+			return fmt.Errorf("unable to marshal resource config: %w", err)
+		}
+		if existed && bytes.Equal(old, y) {
+			return nil
+		}
+		if err := cr.writeFileToPath(path, y); err != nil {
+			return err
+		}
+		if existed {
+			message = "Updated " + message
+		} else {
+			message = "Created " + message
+		}
+	}
+	if author != unknownAuthor {
+		provenance.FieldManager = author
+	}
+	if correlate {
+		author = unknownAuthor
+	}
+	message += formatTrailers(provenance)
+	if err := cr.addAndCommitAt(author, author+"@audit.antrea.io", message, when); err != nil {
+		return fmt.Errorf("unable to add/commit watched change: %w", err)
+	}
+	if correlate {
+		if err := cr.addPendingAttribution(path, provenance.ResourceVersion, resource == nil); err != nil {
+			return err
+		}
+	}
+	klog.V(2).InfoS("committed watched change", "resource", message, "author", author)
+	return nil
+}
+
+// lastFieldManager returns the field manager that most recently wrote the
+// object and when, or unknownAuthor and the current time if not recorded.
+func lastFieldManager(resource *unstructured.Unstructured) (string, time.Time) {
+	author, when := unknownAuthor, time.Now()
+	var latest time.Time
+	for _, entry := range resource.GetManagedFields() {
+		if entry.Manager == "" || entry.Time == nil || entry.Time.Time.Before(latest) {
+			continue
+		}
+		latest = entry.Time.Time
+		author, when = entry.Manager, entry.Time.Time
+	}
+	return author, when
+}
+
+// resourceTypeServed reports whether the cluster serves resourceType.
+func (cr *CustomRepo) resourceTypeServed(resourceType ResourceType) (bool, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(resourceType.ListGroupVersionKind())
+	_, err := cr.K8s.ListResource(list, client.Limit(1))
+	if isNoMatchError(err) {
+		klog.V(2).InfoS("resource type not served by cluster - not watching", "apiVersion", list.GetAPIVersion(), "kind", resourceType.Kind)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
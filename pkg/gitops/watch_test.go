@@ -0,0 +1,103 @@
+// Copyright 2021 Antrea Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitops
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func newFakeDynamicClient(t *testing.T, objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	listKinds := map[schema.GroupVersionResource]string{}
+	for _, rt := range registry.Types {
+		listKinds[schema.GroupVersionResource{Group: rt.Group, Version: rt.Version, Resource: rt.Resource}] = rt.Kind + "List"
+	}
+	var unstructuredObjects []runtime.Object
+	for _, obj := range objects {
+		u := &unstructured.Unstructured{}
+		var err error
+		u.Object, err = runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		assert.NoError(t, err, "could not convert object to unstructured")
+		unstructuredObjects = append(unstructuredObjects, u)
+	}
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, unstructuredObjects...)
+}
+
+func TestRunWatcher(t *testing.T) {
+	k8s := &K8sClient{
+		Client: NewClient(np1.DeepCopy()),
+	}
+	cr, err := SetupRepo(k8s, StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	dynamicClient := newFakeDynamicClient(t, np1.DeepCopy())
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	defer func() {
+		close(stopCh)
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		assert.NoError(t, cr.RunWatcher(dynamicClient, 0, stopCh), "could not watch resources")
+	}()
+
+	created := time.Date(2021, 7, 14, 21, 47, 10, 0, time.UTC)
+	npC := np2.DeepCopy()
+	npC.SetName("npC")
+	npC.SetManagedFields([]metav1.ManagedFieldsEntry{
+		{Manager: "kube-controller-manager", Operation: metav1.ManagedFieldsOperationUpdate, Time: &metav1.Time{Time: created.Add(-time.Hour)}},
+		{Manager: "kubectl-create", Operation: metav1.ManagedFieldsOperationUpdate, Time: &metav1.Time{Time: created}},
+	})
+	obj := &unstructured.Unstructured{}
+	obj.Object, err = runtime.DefaultUnstructuredConverter.ToUnstructured(npC)
+	assert.NoError(t, err, "could not convert object to unstructured")
+	gvr := schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}
+	_, err = dynamicClient.Resource(gvr).Namespace("nsA").Create(context.TODO(), obj, metav1.CreateOptions{})
+	assert.NoError(t, err, "could not create watched resource")
+	assert.Eventually(t, func() bool {
+		return headMessage(t, cr) == "Created K8s network policy nsA/npC"
+	}, 5*time.Second, 10*time.Millisecond, "created resource not committed")
+	cr.Mutex.Lock()
+	head, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(head.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	cr.Mutex.Unlock()
+	assert.Equal(t, "kubectl-create", commit.Author.Name, "author is not the last field manager")
+	assert.True(t, created.Equal(commit.Author.When), "author time is not the field manager time")
+	_, provenance := ParseProvenance(commit.Message)
+	if assert.NotNil(t, provenance) {
+		assert.Equal(t, "kubectl-create", provenance.FieldManager)
+	}
+
+	err = dynamicClient.Resource(gvr).Namespace("nsA").Delete(context.TODO(), "npC", metav1.DeleteOptions{})
+	assert.NoError(t, err, "could not delete watched resource")
+	assert.Eventually(t, func() bool {
+		return headMessage(t, cr) == "Deleted K8s network policy nsA/npC"
+	}, 5*time.Second, 10*time.Millisecond, "deleted resource not committed")
+
+	// the unchanged resource listed at startup was not committed again
+	commits, err := cr.FilterCommits("", time.Time{}, time.Time{}, "k8s-policies", "nsA", "npA.yaml", ProvenanceFilter{})
+	assert.NoError(t, err, "could not filter commits")
+	assert.Len(t, commits, 1, "unchanged resource committed by the watcher")
+}
@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 type TagRequestType string
 
 const (
@@ -16,6 +18,107 @@ type TagRequest struct {
 }
 
 type RollbackRequest struct {
-	Tag string `json:"tag,omitempty"`
-	Sha string `json:"sha,omitempty"`
+	Tag       string `json:"tag,omitempty"`
+	Sha       string `json:"sha,omitempty"`
+	DryRun    bool   `json:"dryRun,omitempty"`
+	Resource  string `json:"resource,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Force     bool   `json:"force,omitempty"`
+}
+
+type RevertRequest struct {
+	Sha string `json:"sha"`
+}
+
+type RollbackAction string
+
+const (
+	RollbackCreate RollbackAction = "create"
+	RollbackUpdate RollbackAction = "update"
+	RollbackDelete RollbackAction = "delete"
+)
+
+// RollbackPlanItem describes the cluster operation a rollback would perform on
+// a single object, along with the unified diff of its repository file.
+type RollbackPlanItem struct {
+	Action     RollbackAction `json:"action"`
+	Path       string         `json:"path"`
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Namespace  string         `json:"namespace,omitempty"`
+	Name       string         `json:"name"`
+	Diff       string         `json:"diff,omitempty"`
+}
+
+type RollbackPlan struct {
+	HeadSha   string             `json:"headSha"`
+	TargetSha string             `json:"targetSha"`
+	Items     []RollbackPlanItem `json:"items"`
+}
+
+type RollbackPhase string
+
+const (
+	RollbackPhasePending   RollbackPhase = "pending"
+	RollbackPhaseDelete    RollbackPhase = "delete"
+	RollbackPhaseReset     RollbackPhase = "reset"
+	RollbackPhaseApply     RollbackPhase = "create/update"
+	RollbackPhaseCommit    RollbackPhase = "commit"
+	RollbackPhaseSucceeded RollbackPhase = "succeeded"
+	RollbackPhaseFailed    RollbackPhase = "failed"
+)
+
+type RollbackItemState string
+
+const (
+	RollbackItemPending RollbackItemState = "pending"
+	RollbackItemDone    RollbackItemState = "done"
+	RollbackItemFailed  RollbackItemState = "failed"
+)
+
+// RollbackJobItem tracks the cluster operation on a single object of a
+// rollback job.
+type RollbackJobItem struct {
+	Action RollbackAction    `json:"action"`
+	Path   string            `json:"path"`
+	State  RollbackItemState `json:"state"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// RollbackJob is the status of an asynchronous rollback, as returned by
+// /rollback and /rollback/{id}. Drifted lists the paths that made the rollback
+// fail because the cluster diverged from the repository.
+type RollbackJob struct {
+	ID         string            `json:"id"`
+	TargetSha  string            `json:"targetSha"`
+	Phase      RollbackPhase     `json:"phase"`
+	Items      []RollbackJobItem `json:"items"`
+	Error      string            `json:"error,omitempty"`
+	Drifted    []string          `json:"drifted,omitempty"`
+	StartTime  time.Time         `json:"startTime"`
+	FinishTime *time.Time        `json:"finishTime,omitempty"`
+}
+
+func (j *RollbackJob) Finished() bool {
+	return j.Phase == RollbackPhaseSucceeded || j.Phase == RollbackPhaseFailed
+}
+
+// Provenance describes the API request behind a change, as recorded in the
+// trailers of its commit.
+type Provenance struct {
+	AuditID          string   `json:"auditID,omitempty"`
+	Groups           []string `json:"groups,omitempty"`
+	ImpersonatedUser string   `json:"impersonatedUser,omitempty"`
+	SourceIPs        []string `json:"sourceIPs,omitempty"`
+	UserAgent        string   `json:"userAgent,omitempty"`
+	RequestURI       string   `json:"requestURI,omitempty"`
+	ResponseCode     int32    `json:"responseCode,omitempty"`
+	// FieldManager and ResourceVersion are set instead of the request fields
+	// for changes observed by watching the cluster, when no audit event is
+	// available. Unattributed marks such changes while their audit event is
+	// still expected.
+	FieldManager    string `json:"fieldManager,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+	Unattributed    bool   `json:"unattributed,omitempty"`
 }
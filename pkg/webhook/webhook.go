@@ -16,8 +16,11 @@ package webhook
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-git/go-git/v5/plumbing/object"
@@ -28,9 +31,10 @@ import (
 )
 
 type Change struct {
-	Sha     string `json:"sha"`
-	Author  string `json:"author"`
-	Message string `json:"message"`
+	Sha        string            `json:"sha"`
+	Author     string            `json:"author"`
+	Message    string            `json:"message"`
+	Provenance *types.Provenance `json:"provenance,omitempty"`
 }
 
 func events(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
@@ -42,14 +46,9 @@ func events(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
 		return
 	}
 	klog.V(3).Infof("Audit received: %s", string(body))
-	if err := cr.HandleEventList(body); err != nil {
-		if err.Error() == "rollback in progress" {
-			klog.ErrorS(err, "audit received during rollback")
-			w.WriteHeader(http.StatusServiceUnavailable)
-		} else {
-			klog.ErrorS(err, "unable to process audit event list")
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+	if err := cr.EnqueueEventList(body); err != nil {
+		klog.ErrorS(err, "unable to queue audit event list")
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
@@ -82,19 +81,45 @@ func changes(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
 	resource := filts.Get("resource")
 	namespace := filts.Get("namespace")
 	name := filts.Get("name")
+	provenance := gitops.ProvenanceFilter{
+		AuditID:          filts.Get("auditID"),
+		Group:            filts.Get("group"),
+		ImpersonatedUser: filts.Get("impersonatedUser"),
+		SourceIP:         filts.Get("sourceIP"),
+		UserAgent:        filts.Get("userAgent"),
+		RequestURI:       filts.Get("requestURI"),
+	}
+	if filts.Get("responseCode") != "" {
+		code, err := strconv.ParseInt(filts.Get("responseCode"), 10, 32)
+		if err != nil {
+			klog.ErrorS(err, "invalid response code filter")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		provenance.ResponseCode = int32(code)
+	}
 
-	commits, err := cr.FilterCommits(author, since, until, resource, namespace, name)
+	commits, err := cr.FilterCommits(author, since, until, resource, namespace, name, provenance)
 	if err != nil {
 		klog.ErrorS(err, "unable to process audit event list")
 		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	attributions, err := cr.CommitAttributions(commits)
+	if err != nil {
+		klog.ErrorS(err, "unable to get commit attributions")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
 	var changes []Change
-	for _, c := range commits {
+	for i, c := range commits {
 		chg := Change{}
 		chg.Sha = c.Hash.String()
-		chg.Author = c.Author.Name
-		chg.Message = c.Message
+		chg.Author = attributions[i].Author
+		chg.Message, _ = gitops.ParseProvenance(c.Message)
+		chg.Provenance = attributions[i].Provenance
 		changes = append(changes, chg)
 	}
 	jsonstring, err := json.Marshal(changes)
@@ -175,6 +200,12 @@ func rollback(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if rollbackRequest.Tag == "" && rollbackRequest.Sha == "" {
+		klog.Errorf("rollback request does not specify a tag or sha")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("rollback request must specify a tag or sha"))
+		return
+	}
 	var commit *object.Commit
 	if rollbackRequest.Tag != "" {
 		commit, err = cr.TagToCommit(rollbackRequest.Tag)
@@ -186,13 +217,100 @@ func rollback(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	sha, err := cr.RollbackRepo(commit)
+	opts := gitops.RollbackOptions{
+		Resource:  rollbackRequest.Resource,
+		Namespace: rollbackRequest.Namespace,
+		Name:      rollbackRequest.Name,
+		Force:     rollbackRequest.Force,
+	}
+	if rollbackRequest.DryRun {
+		plan, err := cr.PlanRollback(commit, opts)
+		if err != nil {
+			klog.ErrorS(err, "failed to plan rollback")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		jsonstring, err := json.Marshal(plan)
+		if err != nil {
+			klog.ErrorS(err, "unable to marshal rollback plan")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(jsonstring)
+		return
+	}
+	job := cr.StartRollback(commit, opts)
+	jsonstring, err := json.Marshal(job.Status())
 	if err != nil {
-		klog.ErrorS(err, "failed to rollback repo")
+		klog.ErrorS(err, "unable to marshal rollback job")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	w.Write([]byte("Rollback to commit " + sha + " successful"))
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(jsonstring)
+}
+
+func rollbackStatus(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
+	defer r.Body.Close()
+	if r.Method != "GET" {
+		klog.Errorf("rollback status does not accept non-GET request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/rollback/")
+	job, ok := cr.GetRollbackJob(id)
+	if !ok {
+		klog.Errorf("rollback job %s not found", id)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	jsonstring, err := json.Marshal(job.Status())
+	if err != nil {
+		klog.ErrorS(err, "unable to marshal rollback job")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonstring)
+}
+
+func revert(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
+	defer r.Body.Close()
+	if r.Method != "POST" {
+		klog.Errorf("revert does not accept non-POST request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		klog.ErrorS(err, "unable to read audit body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	revertRequest := types.RevertRequest{}
+	if err := json.Unmarshal(body, &revertRequest); err != nil {
+		klog.ErrorS(err, "unable to marshal request body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	commit, err := cr.HashToCommit(revertRequest.Sha)
+	if err != nil {
+		klog.ErrorS(err, "unable to convert user input into commit object")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sha, err := cr.RevertCommit(commit)
+	var conflictErr *gitops.RevertConflictError
+	if errors.As(err, &conflictErr) {
+		klog.ErrorS(err, "unable to revert commit")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		klog.ErrorS(err, "failed to revert commit")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("Revert of commit " + sha + " successful"))
 }
 
 func ReceiveEvents(port string, cr *gitops.CustomRepo) error {
@@ -205,6 +323,12 @@ func ReceiveEvents(port string, cr *gitops.CustomRepo) error {
 	http.HandleFunc("/rollback", func(w http.ResponseWriter, r *http.Request) {
 		rollback(w, r, cr)
 	})
+	http.HandleFunc("/rollback/", func(w http.ResponseWriter, r *http.Request) {
+		rollbackStatus(w, r, cr)
+	})
+	http.HandleFunc("/revert", func(w http.ResponseWriter, r *http.Request) {
+		revert(w, r, cr)
+	})
 	http.HandleFunc("/tag", func(w http.ResponseWriter, r *http.Request) {
 		tag(w, r, cr)
 	})